@@ -0,0 +1,99 @@
+/*
+A `Baseline` learns the value a rule's window total usually takes, so that a rule can alert when
+traffic deviates from what is normal rather than passing a fixed threshold. The mean and variance
+of the total are kept as exponentially weighted moving averages (EWMA), updated on each tick, so
+recent seconds count for more than older ones and the weight of a second halves after the
+half-life. With daily seasonality a separate average is kept for each hour of the day, in UTC,
+so that the busy hours of one day are compared with the busy hours of the day before rather than
+with the quiet night. A baseline is only used once it has learned for a half-life, and for daily
+seasonality that is a half-life within the hour being compared.
+*/
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	BaselineEWMA  = "ewma"
+	BaselineDaily = "daily"
+
+	defaultHalfLife = 3600
+)
+
+type Baseline struct {
+	seasons []*ewma // averages for each hour of the day, or a single average without seasonality
+	alpha   float64 // weight given to each new value
+	warmup  int     // values each average learns before it is used
+}
+
+// ewma is an exponentially weighted mean and variance.
+type ewma struct {
+	mean     float64
+	variance float64
+	count    int // number of values learned
+}
+
+// NewBaseline returns a new Baseline of the given kind, ewma or daily, whose values halve in
+// weight after halfLife ticks.
+func NewBaseline(kind string, halfLife int) (*Baseline, error) {
+	if halfLife <= 0 {
+		return nil, fmt.Errorf("half-life must be a positive number of seconds")
+	}
+	seasons := 1
+	switch kind {
+	case BaselineEWMA:
+	case BaselineDaily:
+		seasons = 24
+	default:
+		return nil, fmt.Errorf("unknown baseline %q, want ewma or daily", kind)
+	}
+	b := &Baseline{
+		seasons: make([]*ewma, seasons),
+		alpha:   1 - math.Pow(0.5, 1/float64(halfLife)),
+		warmup:  halfLife,
+	}
+	for index := range b.seasons {
+		b.seasons[index] = &ewma{}
+	}
+	return b, nil
+}
+
+// season returns the average for the time t.
+func (b *Baseline) season(t int64) *ewma {
+	if len(b.seasons) == 1 {
+		return b.seasons[0]
+	}
+	hour, seasons := t/3600, int64(len(b.seasons))
+	if t%3600 < 0 {
+		// Division rounds towards zero, so round down for times before the epoch.
+		hour--
+	}
+	return b.seasons[(hour%seasons+seasons)%seasons]
+}
+
+// Learn updates the baseline with the value seen at time t.
+// This call takes O(1)
+func (b *Baseline) Learn(t int64, value float64) {
+	e := b.season(t)
+	if e.count == 0 {
+		e.mean = value
+	} else {
+		diff := value - e.mean
+		increment := b.alpha * diff
+		e.mean += increment
+		e.variance = (1 - b.alpha) * (e.variance + diff*increment)
+	}
+	e.count++
+}
+
+// Expected returns the mean and standard deviation expected at time t, and whether the baseline
+// has learned enough to be used. As traffic is a count of requests its standard deviation is
+// taken to be at least the square root of the mean, as for a Poisson distribution, so that a
+// period of constant traffic does not make any small change an anomaly.
+func (b *Baseline) Expected(t int64) (float64, float64, bool) {
+	e := b.season(t)
+	stddev := math.Max(math.Sqrt(e.variance), math.Sqrt(math.Max(e.mean, 1)))
+	return e.mean, stddev, e.count >= b.warmup
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBaseline(t *testing.T) {
+	baseline, err := NewBaseline(BaselineEWMA, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 9; i++ {
+		baseline.Learn(i, 100)
+	}
+	if _, _, learned := baseline.Expected(9); learned {
+		t.Errorf(`Expected returned learned before the half-life`)
+	}
+	baseline.Learn(9, 100)
+	mean, stddev, learned := baseline.Expected(10)
+	if !learned || mean != 100 || stddev != 10 {
+		t.Errorf(`Expected returned %v, %v, %v, want 100, 10, true`, mean, stddev, learned)
+	}
+
+	// After a half-life of a new value the mean is half way to it.
+	for i := int64(10); i < 20; i++ {
+		baseline.Learn(i, 200)
+	}
+	mean, stddev, _ = baseline.Expected(20)
+	if math.Abs(mean-150) > 1e-9 || stddev <= 10 {
+		t.Errorf(`Expected returned mean %v and standard deviation %v, want 150 and more than 10`, mean, stddev)
+	}
+}
+
+func TestBaselineDaily(t *testing.T) {
+	baseline, err := NewBaseline(BaselineDaily, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := int64(86400)
+	baseline.Learn(day+3*3600, 500)
+	baseline.Learn(day+15*3600, 10)
+
+	// The same hour of the next day is compared with the value learned for that hour.
+	if mean, _, learned := baseline.Expected(2*day + 3*3600 + 59); !learned || mean != 500 {
+		t.Errorf(`Expected at 03:00 returned mean %v, %v, want 500, true`, mean, learned)
+	}
+	if mean, _, learned := baseline.Expected(2*day + 15*3600); !learned || mean != 10 {
+		t.Errorf(`Expected at 15:00 returned mean %v, %v, want 10, true`, mean, learned)
+	}
+	if _, _, learned := baseline.Expected(2*day + 4*3600); learned {
+		t.Errorf(`Expected at 04:00 returned learned without any values`)
+	}
+
+	// A time before the epoch falls in the hour of the day it is in.
+	baseline.Learn(-3601, 20)
+	if mean, _, learned := baseline.Expected(22 * 3600); !learned || mean != 20 {
+		t.Errorf(`Expected at 22:00 after learning at -3601 returned mean %v, %v, want 20, true`, mean, learned)
+	}
+}
+
+func TestNewBaselineErrors(t *testing.T) {
+	if _, err := NewBaseline("weekly", 10); err == nil {
+		t.Errorf(`NewBaseline("weekly", 10) returned no error`)
+	}
+	if _, err := NewBaseline(BaselineEWMA, 0); err == nil {
+		t.Errorf(`NewBaseline("ewma", 0) returned no error`)
+	}
+}
@@ -0,0 +1,41 @@
+/*
+`Clock` abstracts the system clock so that the real-time `Player` can be driven by a fake
+clock in tests.
+*/
+package main
+
+import "time"
+
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers the time at regular intervals, mirroring time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// systemClock is a Clock backed by the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t systemTicker) Stop() {
+	t.ticker.Stop()
+}
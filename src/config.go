@@ -0,0 +1,457 @@
+/*
+`Config` holds the settings of a run: the inputs and how to read them, how often to report
+stats, and the alert rules. Settings may be loaded from a JSON config file with -config, and
+any command line flag which is given overrides the value in the file. The config is validated
+as a whole before the `Player` is built, so that every mistake is reported with the setting
+it relates to. On SIGHUP the file is read again and the alert rules and stats settings are
+applied to the running `Player`. Settings for the inputs can only be changed by restarting.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+)
+
+const (
+	defaultMinRequests = 100
+)
+
+type Config struct {
+	Inputs          []string          `json:"inputs"`
+	Format          string            `json:"format"`
+	Fields          map[string]string `json:"fields"`
+	Follow          bool              `json:"follow"`
+	FromStart       bool              `json:"from_start"`
+	Realtime        bool              `json:"realtime"`
+	Delay           int               `json:"delay"`
+	MaxLateness     Duration          `json:"max_lateness"`
+	ReorderCapacity int               `json:"reorder_capacity"`
+	Rejects         string            `json:"rejects"`
+	Output          string            `json:"output"`
+	OutputFile      string            `json:"output_file"`
+	Strict          bool              `json:"strict"`
+	PerSource       bool              `json:"per_source"`
+	Stats           StatsConfig       `json:"stats"`
+	Alert           AlertConfig       `json:"alert"`
+	Rules           []Rule            `json:"rules"`
+	Webhook         WebhookConfig     `json:"webhook"`
+}
+
+type StatsConfig struct {
+	Interval   int         `json:"interval"`    // seconds between reports
+	TopK       int         `json:"top_k"`       // number of sections to report
+	TopHosts   int         `json:"top_hosts"`   // number of client hosts to report, 0 to disable
+	TopUsers   int         `json:"top_users"`   // number of users to report, 0 to disable
+	TopStatus  int         `json:"top_status"`  // number of status codes to report, 0 to disable
+	TopMethods int         `json:"top_methods"` // number of HTTP methods to report, 0 to disable
+	Dimensions []Dimension `json:"dimensions"`  // further rankings to report
+}
+
+type AlertConfig struct {
+	Window            int      `json:"window"`             // duration of the windows of the rules below in seconds
+	Rps               int      `json:"rps"`                // average requests per second threshold for high traffic
+	RecoverRps        int      `json:"recover_rps"`        // average requests per second high traffic recovers below, 0 for rps
+	CriticalRps       int      `json:"critical_rps"`       // average requests per second at which high traffic is critical, 0 for always critical
+	MinRps            float64  `json:"min_rps"`            // average requests per second floor for low traffic, 0 to disable
+	Warmup            int      `json:"warmup"`             // seconds after startup before low traffic alerts, 0 for the window
+	Bps               int64    `json:"bps"`                // average bytes per second threshold for high bandwidth, 0 to disable
+	SectionRps        int      `json:"section_rps"`        // average requests per second threshold for a single section, 0 to disable
+	SectionBy         string   `json:"section_by"`         // attribute for section_rps, section or endpoint
+	ErrorRate         float64  `json:"error_rate"`         // percentage of 5xx responses to alert at, 0 to disable
+	ClientErrorRate   float64  `json:"client_error_rate"`  // percentage of 4xx responses to alert at, 0 to disable
+	MinRequests       int      `json:"min_requests"`       // requests needed in the window before an error rate alert
+	Latency           Duration `json:"latency"`            // latency percentile threshold for high latency, 0 to disable
+	LatencyPercentile float64  `json:"latency_percentile"` // percentile of request times compared against latency
+	Anomaly           float64  `json:"anomaly"`            // standard deviations from the baseline of requests to alert at, 0 to disable
+	Baseline          string   `json:"baseline"`           // baseline learned for anomaly, ewma or daily
+	For               int      `json:"for"`                // seconds a threshold must be passed before an alert fires
+	RecoverFor        int      `json:"recover_for"`        // seconds a recover threshold must be passed before an alert recovers
+	FlapLimit         int      `json:"flap_limit"`         // changes of state within 10 minutes above which alerts are suppressed, 0 to disable
+}
+
+// Duration is a time.Duration which is read from JSON as a string such as "5s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\"")
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// DefaultConfig returns the config used when no config file or flags are given.
+func DefaultConfig() Config {
+	return Config{
+		Format:          FormatCSV,
+		Delay:           defaultRealtimeDelay,
+		MaxLateness:     Duration{defaultMaxLateness * time.Second},
+		ReorderCapacity: defaultReorderCapacity,
+		Output:          OutputText,
+		Stats: StatsConfig{
+			Interval:   10,
+			TopK:       defaultShowTopK,
+			TopHosts:   defaultShowTopKRanking,
+			TopUsers:   defaultShowTopKRanking,
+			TopStatus:  defaultShowTopKRanking,
+			TopMethods: defaultShowTopKRanking,
+		},
+		Alert: AlertConfig{
+			Window:            120,
+			Rps:               10,
+			SectionBy:         "section",
+			MinRequests:       defaultMinRequests,
+			LatencyPercentile: defaultPercentile,
+			Baseline:          BaselineEWMA,
+		},
+		Webhook: WebhookConfig{
+			Timeout:   Duration{defaultWebhookTimeout},
+			Retries:   defaultWebhookRetries,
+			Backoff:   Duration{defaultWebhookBackoff},
+			QueueSize: defaultWebhookQueueSize,
+		},
+	}
+}
+
+// LoadConfig reads a JSON config file. Settings which are not in the file keep their defaults.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line := bytes.Count(data[:syntaxErr.Offset], []byte("\n")) + 1
+			return config, fmt.Errorf("%s:%v: %v", path, line, err)
+		}
+		return config, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Validate checks that every setting is usable.
+func (c Config) Validate() error {
+	if len(c.Inputs) == 0 {
+		return fmt.Errorf("no inputs given")
+	}
+	sources := make(map[string]bool)
+	for index, input := range c.Inputs {
+		// Inputs with the same name would be silently merged into a single source.
+		source, _ := ParseSource(input)
+		if sources[source] {
+			return fmt.Errorf("inputs[%v]: source %q is used by more than one input, prefix each with a unique name=", index, source)
+		}
+		sources[source] = true
+	}
+	if _, err := NewParser(c.Format, c.Fields); err != nil {
+		return fmt.Errorf("format: %v", err)
+	}
+	if c.Output != OutputText && c.Output != OutputJSON {
+		return fmt.Errorf("output must be text or json")
+	}
+	if len(c.Webhook.URL) > 0 {
+		if err := c.Webhook.Validate(); err != nil {
+			return fmt.Errorf("webhook %v", err)
+		}
+	}
+	if c.Stats.Interval <= 0 {
+		return fmt.Errorf("stats interval must be a positive number of seconds")
+	}
+	if c.Stats.TopK < 0 || c.Stats.TopHosts < 0 || c.Stats.TopUsers < 0 || c.Stats.TopStatus < 0 || c.Stats.TopMethods < 0 {
+		return fmt.Errorf("stats top_k, top_hosts, top_users, top_status and top_methods must not be negative")
+	}
+	dimensions := make(map[string]bool)
+	for index, dimension := range c.Stats.Dimensions {
+		if err := dimension.Validate(); err != nil {
+			return fmt.Errorf("stats dimensions[%v]: %v", index, err)
+		}
+		if dimensions[dimension.Name] {
+			return fmt.Errorf("stats dimensions[%v]: dimension %q is defined more than once", index, dimension.Name)
+		}
+		dimensions[dimension.Name] = true
+	}
+	if c.Alert.Window <= 0 {
+		return fmt.Errorf("alert window must be a positive number of seconds")
+	}
+	if c.Alert.Rps <= 0 {
+		return fmt.Errorf("alert rps must be positive")
+	}
+	if c.Alert.SectionBy != "section" && c.Alert.SectionBy != "endpoint" {
+		return fmt.Errorf("alert section_by must be section or endpoint")
+	}
+	if c.Alert.MinRps < 0 || c.Alert.Warmup < 0 {
+		return fmt.Errorf("alert min_rps and warmup must not be negative")
+	}
+	if c.Alert.Latency.Duration < 0 {
+		return fmt.Errorf("alert latency must not be negative")
+	}
+	if c.MaxLateness.Duration < 0 {
+		return fmt.Errorf("max_lateness must not be negative")
+	}
+	if c.ReorderCapacity <= 0 {
+		return fmt.Errorf("reorder_capacity must be positive")
+	}
+	if c.Realtime && int64(c.Delay) < c.lateness() {
+		return fmt.Errorf("delay must be at least max_lateness, otherwise late log lines are rejected")
+	}
+
+	names := make(map[string]bool)
+	for _, rule := range c.alertRules() {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("alert: %v", err)
+		}
+		names[rule.Name] = true
+	}
+	for index, rule := range c.Rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("rules[%v]: %v", index, err)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("rules[%v]: rule %q is defined more than once", index, rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return nil
+}
+
+// alertRules returns the rules created from the alert settings.
+func (c Config) alertRules() []Rule {
+	highTraffic := HighTrafficRule(c.Alert.Rps, c.Alert.Window)
+	highTraffic.Recover = float64(c.Alert.RecoverRps)
+	if c.Alert.CriticalRps > 0 {
+		// High traffic warns at rps and escalates at critical_rps.
+		highTraffic.Severity = SeverityWarning
+		highTraffic.Critical = float64(c.Alert.CriticalRps)
+	}
+	rules := []Rule{highTraffic}
+	if c.Alert.MinRps > 0 {
+		rule := LowTrafficRule(c.Alert.MinRps, c.Alert.Window)
+		rule.Warmup = c.Alert.Warmup
+		rules = append(rules, rule)
+	}
+	if c.Alert.Bps > 0 {
+		rules = append(rules, HighBandwidthRule(c.Alert.Bps, c.Alert.Window))
+	}
+	if c.Alert.SectionRps > 0 {
+		rules = append(rules, SectionTrafficRule(c.Alert.SectionRps, c.Alert.SectionBy, c.Alert.Window))
+	}
+	if c.Alert.ErrorRate > 0 {
+		rules = append(rules, ErrorRateRule("server_errors", "Server error rate", "5xx",
+			c.Alert.ErrorRate, c.Alert.MinRequests, c.Alert.Window))
+	}
+	if c.Alert.ClientErrorRate > 0 {
+		rules = append(rules, ErrorRateRule("client_errors", "Client error rate", "4xx",
+			c.Alert.ClientErrorRate, c.Alert.MinRequests, c.Alert.Window))
+	}
+	if c.Alert.Latency.Duration > 0 {
+		rules = append(rules, HighLatencyRule(c.Alert.LatencyPercentile, c.Alert.Latency.Seconds(), c.Alert.Window))
+	}
+	if c.Alert.Anomaly > 0 {
+		rules = append(rules, TrafficAnomalyRule(c.Alert.Anomaly, c.Alert.Baseline, c.Alert.Window))
+	}
+	for index := range rules {
+		rules[index].For = c.Alert.For
+		rules[index].RecoverFor = c.Alert.RecoverFor
+		rules[index].FlapLimit = c.Alert.FlapLimit
+	}
+	return rules
+}
+
+// AlertRules returns every rule to be evaluated, starting with those created from the alert
+// settings.
+func (c Config) AlertRules() []Rule {
+	return append(c.alertRules(), c.Rules...)
+}
+
+// AllDimensions returns every dimension to be ranked, starting with the sections, hosts, users,
+// status codes and methods. A configured dimension with the name of one of these replaces it,
+// such as to count sections or hosts approximately.
+func (c StatsConfig) AllDimensions() []Dimension {
+	dimensions := defaultDimensions()
+	for index, topK := range []int{c.TopK, c.TopHosts, c.TopUsers, c.TopStatus, c.TopMethods} {
+		dimensions[index].TopK = topK
+	}
+	for _, dimension := range c.Dimensions {
+		replaced := false
+		for index := range dimensions {
+			if dimensions[index].Name == dimension.Name {
+				dimensions[index] = dimension
+				replaced = true
+			}
+		}
+		if !replaced {
+			dimensions = append(dimensions, dimension)
+		}
+	}
+	return dimensions
+}
+
+// SetDimension adds a dimension, replacing any existing dimension with the same name.
+func (c *StatsConfig) SetDimension(dimension Dimension) {
+	for index := range c.Dimensions {
+		if c.Dimensions[index].Name == dimension.Name {
+			c.Dimensions[index] = dimension
+			return
+		}
+	}
+	c.Dimensions = append(c.Dimensions, dimension)
+}
+
+// SetRule adds a rule, replacing any existing rule with the same name.
+func (c *Config) SetRule(rule Rule) {
+	for index := range c.Rules {
+		if c.Rules[index].Name == rule.Name {
+			c.Rules[index] = rule
+			return
+		}
+	}
+	c.Rules = append(c.Rules, rule)
+}
+
+// RestartSettings returns the names of the settings which differ from other and can only be
+// changed by restarting.
+func (c Config) RestartSettings(other Config) []string {
+	var names []string
+	settings := []struct {
+		name        string
+		this, other interface{}
+	}{
+		{"inputs", c.Inputs, other.Inputs},
+		{"format", c.Format, other.Format},
+		{"fields", c.Fields, other.Fields},
+		{"follow", c.Follow, other.Follow},
+		{"from_start", c.FromStart, other.FromStart},
+		{"realtime", c.Realtime, other.Realtime},
+		{"delay", c.Delay, other.Delay},
+		{"max_lateness", c.MaxLateness, other.MaxLateness},
+		{"reorder_capacity", c.ReorderCapacity, other.ReorderCapacity},
+		{"rejects", c.Rejects, other.Rejects},
+		{"output", c.Output, other.Output},
+		{"output_file", c.OutputFile, other.OutputFile},
+		{"webhook", c.Webhook, other.Webhook},
+		{"strict", c.Strict, other.Strict},
+		{"per_source", c.PerSource, other.PerSource},
+	}
+	for _, setting := range settings {
+		if !reflect.DeepEqual(setting.this, setting.other) {
+			names = append(names, setting.name)
+		}
+	}
+	return names
+}
+
+// lateness returns the maximum lateness rounded up to whole seconds.
+func (c Config) lateness() int64 {
+	return int64((c.MaxLateness.Duration + time.Second - 1) / time.Second)
+}
+
+// NewPlayerFromConfig validates the config and returns a Player which reads the configured
+// inputs and evaluates the configured rules.
+func NewPlayerFromConfig(config Config) (*Player, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	newParser, err := NewParserFactory(config.Format, config.Fields)
+	if err != nil {
+		return nil, err
+	}
+
+	rejects := NewRejectLog(nil)
+	var readers []LogSource
+	stdin := false
+	for _, input := range config.Inputs {
+		source, pattern := ParseSource(input)
+		if pattern == stdinInput {
+			if stdin {
+				return nil, fmt.Errorf("stdin can only be read once")
+			}
+			stdin = true
+		}
+		inputs, err := ExpandInputs([]string{pattern})
+		if err != nil {
+			return nil, err
+		}
+		reader := NewReader(pattern)
+		reader.source = source
+		reader.inputs = inputs
+		reader.newParser = newParser
+		reader.follow = config.Follow
+		reader.fromStart = config.FromStart
+		reader.lateness = config.lateness()
+		reader.capacity = config.ReorderCapacity
+		reader.strict = config.Strict
+		reader.rejects = rejects
+		// A followed log read from its end only has new lines, so it too is driven by the clock.
+		if config.Realtime || (config.Follow && !config.FromStart) {
+			reader.clock = systemClock{}
+		}
+		readers = append(readers, reader)
+	}
+
+	player := NewPlayer("", int64(config.Stats.Interval), config.Alert.Rps, config.Alert.Window)
+	if err := player.stats.Configure(config.Stats); err != nil {
+		return nil, err
+	}
+	// Replace the high traffic rule added by NewPlayer, as the alert settings may change it.
+	if err := player.monitor.SetRules(config.AlertRules()); err != nil {
+		return nil, err
+	}
+	player.perSource = config.PerSource
+	// Once a sink is added the Player is closed on error, to stop the sinks and close their files.
+	player.AddSink(NewConsoleSink(config.Output))
+	if len(config.OutputFile) > 0 {
+		sink, err := NewFileSink(config.OutputFile, config.Output)
+		if err != nil {
+			player.Close()
+			return nil, err
+		}
+		player.AddSink(sink)
+	}
+	if len(config.Webhook.URL) > 0 {
+		sink, err := NewWebhookSink(config.Webhook)
+		if err != nil {
+			player.Close()
+			return nil, err
+		}
+		player.AddSink(sink)
+	}
+	if len(readers) == 1 {
+		player.reader = readers[0]
+	} else {
+		player.reader = NewMerger(readers)
+	}
+	if config.Realtime {
+		player.clock = systemClock{}
+		player.delay = int64(config.Delay)
+	}
+	if len(config.Rejects) > 0 {
+		// Opened last so that the file is only left open by a Player which will be closed.
+		rejectsFile, err := os.OpenFile(config.Rejects, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			player.Close()
+			return nil, fmt.Errorf("unable to open rejects file: %v", err)
+		}
+		rejects.out = rejectsFile
+		player.closers = append(player.closers, rejects)
+	}
+	return player, nil
+}
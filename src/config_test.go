@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeConfig writes a config file to a temporary directory and returns its path.
+func writeConfig(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfig("../input/sample_config.json")
+	if err != nil {
+		t.Fatalf(`LoadConfig returned %v`, err)
+	}
+	want := DefaultConfig()
+	want.Inputs = []string{"../input/sample_csv.txt"}
+	want.Stats.TopK = 5
+	want.Rules = []Rule{{Name: "errors", Description: "Server errors", Metric: MetricHits,
+		Filter: map[string]string{"status": "5xx"}, GroupBy: "section", Window: 10, Op: ">=",
+		Threshold: 15, Severity: SeverityWarning}}
+	if !cmp.Equal(config, want) {
+		t.Errorf(`LoadConfig returned %+v, want %+v`, config, want)
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf(`Validate returned %v`, err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	var tests = []struct {
+		data string
+		want string
+	}{
+		{`{"inputs": ["a"], "colour": "red"}`, `unknown field "colour"`},
+		{"{\n\"inputs\": [\"a\"],\n}", "config.json:3:"},
+		{`{"max_lateness": 5}`, "duration must be a string"},
+		{`{"rules": [{"name": "a", "size": 1}]}`, `unknown field "size"`},
+		{`{"rules": [{"name": "a", "severity": "fatal"}]}`, "unknown severity"},
+	}
+	for _, test := range tests {
+		_, err := LoadConfig(writeConfig(t, test.data))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf(`LoadConfig(%q) returned %v, want %q`, test.data, err, test.want)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	rule := Rule{Name: "a", Metric: MetricHits, Window: 10, Op: ">="}
+	var tests = []struct {
+		update func(c *Config)
+		want   string
+	}{
+		{func(c *Config) { c.Inputs = nil }, "no inputs"},
+		{func(c *Config) { c.Inputs = []string{"/a/access.log", "/b/access.log"} }, `inputs[1]: source "access.log"`},
+		{func(c *Config) { c.Inputs = []string{"web1=/a/access.log", "web1=/b/access.log"} }, `source "web1"`},
+		{func(c *Config) { c.Format = "xml" }, "format"},
+		{func(c *Config) { c.Output = "xml" }, "output"},
+		{func(c *Config) { c.Webhook.URL = "hooks.example.com" }, "webhook url"},
+		{func(c *Config) { c.Stats.Interval = 0 }, "stats interval"},
+		{func(c *Config) { c.Stats.TopK = -1 }, "top_k"},
+		{func(c *Config) { c.Alert.Window = 0 }, "alert window"},
+		{func(c *Config) { c.Alert.Rps = 0 }, "alert rps"},
+		{func(c *Config) { c.ReorderCapacity = 0 }, "reorder_capacity"},
+		{func(c *Config) { c.Alert.SectionBy = "host" }, "section_by"},
+		{func(c *Config) { c.Stats.Dimensions = []Dimension{{Name: "a", Key: "colour"}} }, "stats dimensions[0]"},
+		{func(c *Config) {
+			c.Stats.Dimensions = []Dimension{{Name: "a", Key: "remotehost"}, {Name: "a", Key: "method"}}
+		}, "more than once"},
+		{func(c *Config) { c.Alert.ErrorRate = 150 }, "percentage"},
+		{func(c *Config) { c.Alert.Latency = Duration{-time.Second} }, "alert latency"},
+		{func(c *Config) { c.Alert.MinRps, c.Alert.Warmup = 1, -1 }, "warmup"},
+		{func(c *Config) { c.Alert.Rps, c.Alert.CriticalRps = 10, 5 }, "critical"},
+		{func(c *Config) { c.Alert.Anomaly, c.Alert.Baseline = 3, "weekly" }, "unknown baseline"},
+		{func(c *Config) { c.Alert.Latency, c.Alert.LatencyPercentile = Duration{time.Second}, 101 }, "percentile"},
+		{func(c *Config) { c.Realtime, c.Delay, c.MaxLateness = true, 1, Duration{1500 * time.Millisecond} }, "delay"},
+		{func(c *Config) { c.Rules = []Rule{rule, {Name: "b"}} }, "rules[1]"},
+		{func(c *Config) { c.Rules = []Rule{rule, rule} }, `rules[1]: rule "a" is defined more than once`},
+		{func(c *Config) { c.Rules = []Rule{{Name: "high_traffic", Metric: MetricHits, Window: 1, Op: ">="}} }, "more than once"},
+	}
+	for index, test := range tests {
+		config := DefaultConfig()
+		config.Inputs = []string{"a"}
+		test.update(&config)
+		err := config.Validate()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf(`Validate test %v returned %v, want %q`, index, err, test.want)
+		}
+	}
+}
+
+func TestConfigSetRule(t *testing.T) {
+	config := DefaultConfig()
+	config.SetRule(Rule{Name: "a", Window: 10})
+	config.SetRule(Rule{Name: "b", Window: 10})
+	config.SetRule(Rule{Name: "a", Window: 20})
+	want := []Rule{{Name: "a", Window: 20}, {Name: "b", Window: 10}}
+	if !cmp.Equal(config.Rules, want) {
+		t.Errorf(`SetRule returned %+v, want %+v`, config.Rules, want)
+	}
+}
+
+func TestNewPlayerFromConfigRejects(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.Inputs = []string{filepath.Join(dir, "access.csv")}
+	config.Rejects = filepath.Join(dir, "rejects.csv")
+	appendFile(t, config.Inputs[0], testHeader)
+	player, err := NewPlayerFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rejects file is closed with the player.
+	file := player.reader.(*Reader).rejects.out.(*os.File)
+	if err := player.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString("line\n"); !errors.Is(err, os.ErrClosed) {
+		t.Errorf(`Writing to the rejects file of a closed player returned %v, want %v`, err, os.ErrClosed)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+`Counter` maintains a ranking of keys, such as sections or hosts, based on the number of hits.
+Two data structures are used to efficiently perform this. An unordered map, with key as key
+and hits as value, keeps count of each key’s total number of hits. An ordered map, with hits
+as key and keys as value, tracks the top keys. Updating the former in O(1) time allows the
+latter to be updated in O(log n) time. The bytes served are also totalled for each key.
+*/
+package main
+
+import (
+	"sort"
+
+	"github.com/google/btree"
+)
+
+type TopKEntry struct {
+	hits int             // number of hits
+	keys map[string]bool // keys with this number of hits
+}
+
+// Less is a comparator used by Counter.topK to satisfy the btree.Item interface.
+func (entry TopKEntry) Less(than btree.Item) bool {
+	return entry.hits < than.(TopKEntry).hits
+}
+
+type TopKResult struct {
+	key   string
+	hits  int
+	bytes int64 // bytes served for the key
+	error int   // maximum overestimate of hits, 0 when exact
+}
+
+type Counter struct {
+	hits  map[string]int   // tracks the number of hits for each key, uses O(n) space
+	bytes map[string]int64 // tracks the bytes served for each key, uses O(n) space
+	topK  *btree.BTree     // maintains the list of keys ordered by number of hits, uses O(n) space
+}
+
+// NewCounter returns a new Counter used to rank keys.
+func NewCounter() *Counter {
+	return &Counter{
+		hits:  make(map[string]int),
+		bytes: make(map[string]int64),
+		topK:  btree.New(2),
+	}
+}
+
+// Hit records an additional hit for a given key, serving the given number of bytes.
+// This call takes:
+//   O(1): to update counts.
+//   O(log n):  to update the top k.
+func (c *Counter) Hit(key string, bytes int) {
+	count, found := c.hits[key]
+	c.hits[key]++
+	c.bytes[key] += int64(bytes)
+
+	if found {
+		// Remove key from its current position in the topK.
+		item := c.topK.Get(TopKEntry{count, nil})
+		if item != nil {
+			delete(item.(TopKEntry).keys, key)
+		}
+		if len(item.(TopKEntry).keys) == 0 {
+			c.topK.Delete(item)
+		}
+	}
+
+	// Add key to its new position in the topK.
+	item := c.topK.Get(TopKEntry{count + 1, nil})
+	if item == nil {
+		c.topK.ReplaceOrInsert(TopKEntry{count + 1, map[string]bool{key: true}})
+	} else {
+		item.(TopKEntry).keys[key] = true
+	}
+}
+
+// Clear resets all hit counts.
+func (c *Counter) Clear() {
+	for k := range c.hits {
+		delete(c.hits, k)
+	}
+	for k := range c.bytes {
+		delete(c.bytes, k)
+	}
+	c.topK.Clear(false)
+}
+
+// Hits returns the number of hits for a given key.
+// This call takes O(1)
+func (c *Counter) Hits(key string) int {
+	return c.hits[key]
+}
+
+// Bytes returns the number of bytes served for a given key.
+// This call takes O(1)
+func (c *Counter) Bytes(key string) int64 {
+	return c.bytes[key]
+}
+
+// TopK returns the top k number of keys with the most hits. If multiple keys have the same
+// number of hits, they are all returned.
+// This call takes O(log n)
+func (c *Counter) TopK(k int) []TopKResult {
+	var result []TopKResult
+	if k == 0 || c.topK.Len() == 0 {
+		return result
+	}
+
+	it := func(i btree.Item) bool {
+		hits := i.(TopKEntry).hits
+		// Order keys with the same number of hits so that reports are consistent.
+		keys := make([]string, 0, len(i.(TopKEntry).keys))
+		for key := range i.(TopKEntry).keys {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			result = append(result, TopKResult{key, hits, c.bytes[key], 0})
+			k--
+		}
+		return k > 0
+	}
+	c.topK.Descend(it)
+
+	return result
+}
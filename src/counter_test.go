@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCounterTopKTies(t *testing.T) {
+	counter := NewCounter()
+	for _, key := range []string{"10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3"} {
+		counter.Hit(key, 100)
+	}
+
+	got := counter.TopK(2)
+	want := []TopKResult{{"10.0.0.1", 2, 200, 0}, {"10.0.0.3", 2, 200, 0}}
+	if !cmp.Equal(got, want, cmp.AllowUnexported(TopKResult{})) {
+		t.Errorf(`counter.TopK(2) returned %v, want %v`, got, want)
+	}
+}
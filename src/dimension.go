@@ -0,0 +1,111 @@
+/*
+A `Dimension` is a ranking reported in the stats, such as the top client hosts. Its key is made
+of one or more `LogModel` attributes joined by +, for example `method+section` ranks requests
+such as "GET /api". Each key is compiled into an `Extractor`, so new rankings can be added to
+the config or on the command line without changes to `Stats`.
+
+By default a dimension is counted exactly by a `Counter`, which grows with every value seen in
+the interval. A dimension with a capacity is instead counted approximately by `SpaceSaving`,
+which holds at most that many values and reports the error bound of each count.
+*/
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Dimension struct {
+	Name     string `json:"name"`     // name of the ranking in reports
+	Key      string `json:"key"`      // attributes which make up the key, joined by +
+	TopK     int    `json:"top_k"`    // number of values to report, 0 to disable
+	Capacity int    `json:"capacity"` // number of values counted approximately, 0 to count every value exactly
+}
+
+// Extractor returns the key of a log line for a dimension, or false if the line has no value
+// for one of the key's attributes.
+type Extractor func(line LogModel) (string, bool)
+
+// NewExtractor returns an Extractor for a key made of attributes joined by +.
+func NewExtractor(key string) (Extractor, error) {
+	attributes := strings.Split(key, "+")
+	for _, attribute := range attributes {
+		if !isAttribute(attribute) {
+			return nil, fmt.Errorf("unknown attribute %q in key %q", attribute, key)
+		}
+	}
+	if len(attributes) == 1 {
+		attribute := attributes[0]
+		return func(line LogModel) (string, bool) {
+			value, _ := line.Attribute(attribute)
+			return value, len(value) > 0
+		}, nil
+	}
+	return func(line LogModel) (string, bool) {
+		values := make([]string, len(attributes))
+		for index, attribute := range attributes {
+			value, _ := line.Attribute(attribute)
+			if len(value) == 0 {
+				return "", false
+			}
+			values[index] = value
+		}
+		return strings.Join(values, " "), true
+	}, nil
+}
+
+// Validate checks that the dimension is named and has a valid key.
+func (d Dimension) Validate() error {
+	if len(d.Name) == 0 {
+		return fmt.Errorf("dimension has no name")
+	}
+	if _, err := NewExtractor(d.Key); err != nil {
+		return fmt.Errorf("dimension %q %v", d.Name, err)
+	}
+	if d.TopK < 0 {
+		return fmt.Errorf("dimension %q top_k must not be negative", d.Name)
+	}
+	if d.Capacity < 0 {
+		return fmt.Errorf("dimension %q capacity must not be negative", d.Name)
+	}
+	if d.Capacity > 0 && d.Capacity < d.TopK {
+		return fmt.Errorf("dimension %q capacity must be at least top_k", d.Name)
+	}
+	return nil
+}
+
+// newCounter returns the counter used to rank the dimension.
+func (d Dimension) newCounter() TopKCounter {
+	if d.Capacity > 0 {
+		return NewSpaceSaving(d.Capacity)
+	}
+	return NewCounter()
+}
+
+// ParseDimension parses a dimension given as name=key, optionally followed by :k for the
+// number of values to report and :capacity to count approximately, such as
+// routes=method+section:5 or endpoints=endpoint:10:1000.
+func ParseDimension(spec string) (Dimension, error) {
+	split := strings.SplitN(spec, "=", 2)
+	if len(split) != 2 {
+		return Dimension{}, fmt.Errorf("invalid dimension %q, want name=key", spec)
+	}
+	parts := strings.Split(split[1], ":")
+	if len(parts) > 3 {
+		return Dimension{}, fmt.Errorf("invalid dimension %q, want name=key:k:capacity", spec)
+	}
+	dimension := Dimension{Name: split[0], Key: parts[0], TopK: defaultShowTopKRanking}
+	var err error
+	if len(parts) > 1 {
+		if dimension.TopK, err = strconv.Atoi(parts[1]); err != nil {
+			return Dimension{}, fmt.Errorf("invalid dimension top k %q: %v", parts[1], err)
+		}
+	}
+	if len(parts) > 2 {
+		if dimension.Capacity, err = strconv.Atoi(parts[2]); err != nil {
+			return Dimension{}, fmt.Errorf("invalid dimension capacity %q: %v", parts[2], err)
+		}
+	}
+	return dimension, dimension.Validate()
+}
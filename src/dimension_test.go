@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewExtractor(t *testing.T) {
+	line := LogModel{method: "GET", section: "/api", status: 200}
+	var tests = []struct {
+		key   string
+		line  LogModel
+		want  string
+		found bool
+	}{
+		{"section", line, "/api", true},
+		{"status", line, "200", true},
+		{"method+section", line, "GET /api", true},
+		{"method+useragent", line, "", false},
+		{"useragent", line, "", false},
+	}
+	for _, test := range tests {
+		extract, err := NewExtractor(test.key)
+		if err != nil {
+			t.Errorf(`NewExtractor(%q) returned %v`, test.key, err)
+			continue
+		}
+		if got, found := extract(test.line); got != test.want || found != test.found {
+			t.Errorf(`Extractor %q returned %q, %v, want %q, %v`, test.key, got, found, test.want, test.found)
+		}
+	}
+
+	for _, key := range []string{"colour", "method+", ""} {
+		if _, err := NewExtractor(key); err == nil {
+			t.Errorf(`NewExtractor(%q) returned no error`, key)
+		}
+	}
+}
+
+func TestParseDimension(t *testing.T) {
+	var tests = []struct {
+		input string
+		want  Dimension
+		fail  bool
+	}{
+		{"routes=method+section:3", Dimension{Name: "routes", Key: "method+section", TopK: 3}, false},
+		{"agents=useragent", Dimension{Name: "agents", Key: "useragent", TopK: defaultShowTopKRanking}, false},
+		{"endpoints=endpoint:10:1000", Dimension{Name: "endpoints", Key: "endpoint", TopK: 10, Capacity: 1000}, false},
+		{"endpoints=endpoint:10:5", Dimension{}, true},
+		{"endpoints=endpoint:10:-1", Dimension{}, true},
+		{"endpoints=endpoint:10:100:1", Dimension{}, true},
+		{"routes", Dimension{}, true},
+		{"=section", Dimension{}, true},
+		{"routes=method+colour", Dimension{}, true},
+		{"routes=section:many", Dimension{}, true},
+		{"routes=section:-1", Dimension{}, true},
+	}
+	for _, test := range tests {
+		got, err := ParseDimension(test.input)
+		if test.fail {
+			if err == nil {
+				t.Errorf(`ParseDimension(%q) returned no error`, test.input)
+			}
+		} else if err != nil || got != test.want {
+			t.Errorf(`ParseDimension(%q) returned %+v, %v, want %+v`, test.input, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+`Follower` provides `tail -F` style access to a growing log file. It implements io.Reader
+but, rather than returning io.EOF when the end of the file is reached, it polls until more
+data is appended. Like `tail -F`, it starts at the end of the file so that only new lines are
+read, unless asked to start from the beginning. On each poll the path is checked to detect log
+rotation: if the path now refers to a different file (rename) it is reopened from the start, and
+if the file has shrunk below the current offset (truncate) reading resumes from the start.
+*/
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFollowPoll = 250 * time.Millisecond
+)
+
+type Follower struct {
+	path   string        // path of the followed file
+	file   *os.File      // currently open file
+	offset int64         // number of bytes read from the current file
+	poll   time.Duration // interval between checks for new data
+	stop   chan struct{} // closed when the follower is closed
+	once   sync.Once
+	mu     sync.Mutex // guards file, which Close may close while Read is waiting
+	closed bool
+}
+
+// NewFollower opens the file at path and returns a Follower reading from its start if fromStart
+// is set, and otherwise from its end.
+func NewFollower(path string, poll time.Duration, fromStart bool) (*Follower, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var offset int64
+	if !fromStart {
+		if offset, err = file.Seek(0, io.SeekEnd); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &Follower{
+		path:   path,
+		file:   file,
+		offset: offset,
+		poll:   poll,
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+// Read reads up to len(p) bytes, blocking until data is available. It only returns io.EOF
+// once the follower has been closed.
+func (f *Follower) Read(p []byte) (int, error) {
+	for {
+		n, more, err := f.read(p)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		if more {
+			continue
+		}
+
+		select {
+		case <-f.stop:
+			return 0, io.EOF
+		case <-time.After(f.poll):
+		}
+	}
+}
+
+// read makes a single attempt to read from the current file. At the end of the file it checks
+// whether the file has been rotated, returning true if there may be new data to read.
+func (f *Follower) read(p []byte) (int, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, false, io.EOF
+	}
+	n, err := f.file.Read(p)
+	f.offset += int64(n)
+	if n > 0 {
+		return n, false, nil
+	}
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+
+	// End of the current file, check whether it has been rotated before waiting.
+	more, err := f.checkRotation()
+	return 0, more, err
+}
+
+// checkRotation reopens or rewinds the file if it has been renamed or truncated. It returns
+// true if there may be new data to read.
+func (f *Follower) checkRotation() (bool, error) {
+	current, err := f.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if current.Size() > f.offset {
+		// Data was appended since the last read.
+		return true, nil
+	}
+
+	latest, err := os.Stat(f.path)
+	if err != nil {
+		// The path may briefly not exist while being rotated.
+		return false, nil
+	}
+
+	if !os.SameFile(current, latest) {
+		file, err := os.Open(f.path)
+		if err != nil {
+			return false, nil
+		}
+		f.file.Close()
+		f.file = file
+		f.offset = 0
+		return true, nil
+	}
+
+	if current.Size() < f.offset {
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		f.offset = 0
+		return true, nil
+	}
+	return false, nil
+}
+
+// Close stops following. Any blocked Read returns io.EOF and the underlying file is closed.
+func (f *Follower) Close() error {
+	var err error
+	f.once.Do(func() {
+		close(f.stop)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.closed = true
+		err = f.file.Close()
+	})
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func appendFile(t *testing.T, path string, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	appendFile(t, path, "first\n")
+
+	f, err := NewFollower(path, time.Millisecond, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Errorf(`Follower read %q, want %q`, got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf(`Follower timed out waiting for %q`, want)
+		}
+	}
+
+	expect("first")
+
+	// Appended lines are read.
+	appendFile(t, path, "second\n")
+	expect("second")
+
+	// Renamed file is replaced by a new file.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "rotated\n")
+	expect("rotated")
+
+	// Truncated file is read from the start.
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "new\n")
+	expect("new")
+
+	f.Close()
+	select {
+	case _, ok := <-lines:
+		if ok {
+			t.Errorf(`Follower returned data after being closed`)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf(`Follower did not stop after being closed`)
+	}
+}
+
+func TestFollowerFromEnd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	appendFile(t, path, "old\n")
+	f, err := NewFollower(path, time.Millisecond, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Only the lines appended after the file was opened are read.
+	appendFile(t, path, "new\n")
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != "new" {
+		t.Errorf(`Follower from the end read %q, want "new"`, scanner.Text())
+	}
+}
+
+func TestFollowerMissingFile(t *testing.T) {
+	if _, err := NewFollower(filepath.Join(t.TempDir(), "missing.log"), time.Millisecond, true); err == nil {
+		t.Errorf(`NewFollower on a missing file returned no error`)
+	}
+}
+
+func TestFollowerClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	appendFile(t, path, "first\n")
+	f, err := NewFollower(path, time.Millisecond, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is closed even if the follower was never read.
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.file.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf(`Reading the file of a closed follower returned %v, want %v`, err, os.ErrClosed)
+	}
+	if n, err := f.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf(`Read of a closed follower returned %v, %v, want 0, EOF`, n, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf(`Second Close returned %v`, err)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Inputs are the log files read by the `Reader`. Each input may be a file path, a glob pattern
+matching several files, or "-" for stdin. Files ending in ".gz" are transparently decompressed.
+When several files are given they are merged by timestamp, so that a day of rotated logs, or the
+logs of each worker of a server, can be replayed in a single run. The files are ordered by the
+timestamp of their first log line to find the latest, which is the one followed in follow mode.
+
+Each input may be prefixed with a source name, such as "web1=/var/log/web1/access.log*". The
+files of each source are read by a separate `Reader` and the sources are merged by timestamp.
+*/
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	stdinInput = "-"
+)
+
+// ParseSource splits an input into its source name and pattern. If no name is given then the
+// base name of the pattern is used, so inputs in different directories need a name to be told
+// apart.
+func ParseSource(input string) (string, string) {
+	split := strings.SplitN(input, "=", 2)
+	if len(split) == 2 && len(split[0]) > 0 && !strings.ContainsAny(split[0], `/\*?[`) {
+		return split[0], split[1]
+	}
+	if input == stdinInput {
+		return "stdin", input
+	}
+	return filepath.Base(input), input
+}
+
+// ExpandInputs expands any glob patterns in the inputs and returns the list of files to read.
+func ExpandInputs(patterns []string) ([]string, error) {
+	var inputs []string
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		if pattern == stdinInput {
+			if len(patterns) > 1 {
+				return nil, fmt.Errorf("stdin cannot be read alongside other inputs")
+			}
+			return []string{stdinInput}, nil
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input pattern %q: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match input %q", pattern)
+		}
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				inputs = append(inputs, match)
+			}
+		}
+	}
+	return inputs, nil
+}
+
+// openInput opens an input for reading, decompressing it if it is gzipped. The last input
+// of a followed Reader is kept open as it grows, and read from its end unless fromStart is set.
+func openInput(path string, follow bool, fromStart bool) (io.ReadCloser, error) {
+	if path == stdinInput {
+		return io.NopCloser(os.Stdin), nil
+	}
+
+	gzipped := strings.HasSuffix(path, ".gz")
+	if follow && !gzipped {
+		follower, err := NewFollower(path, defaultFollowPoll, fromStart)
+		if err != nil {
+			return nil, err
+		}
+		return follower, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !gzipped {
+		return file, nil
+	}
+	dec, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gzipInput{dec, file}, nil
+}
+
+// gzipInput closes both the decompressor and the underlying file.
+type gzipInput struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipInput) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// orderInputs sorts files by the timestamp of their first log line. Files without any
+// readable log lines are placed last.
+func orderInputs(paths []string, newParser ParserFactory) []string {
+	if len(paths) < 2 {
+		return paths
+	}
+
+	first := make(map[string]int64)
+	for _, path := range paths {
+		if date, ok := firstTimestamp(path, newParser()); ok {
+			first[path] = date
+		}
+	}
+
+	ordered := append([]string(nil), paths...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, okA := first[ordered[i]]
+		b, okB := first[ordered[j]]
+		if okA && okB {
+			return a < b
+		}
+		return okA && !okB
+	})
+	return ordered
+}
+
+// readHeader passes the first line of a file to a parser which takes its columns from a header,
+// so that the header is known when a followed file is read from its end.
+func readHeader(path string, parser Parser) {
+	if _, ok := parser.(HeaderParser); !ok {
+		return
+	}
+	input, err := openInput(path, false, true)
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	scanner := bufio.NewScanner(input)
+	if scanner.Scan() {
+		parser.Parse(scanner.Text())
+	}
+}
+
+// firstTimestamp returns the timestamp of the first log line in a file.
+func firstTimestamp(path string, parser Parser) (int64, bool) {
+	input, err := openInput(path, false, true)
+	if err != nil {
+		return 0, false
+	}
+	defer input.Close()
+
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		if line, err := parser.Parse(scanner.Text()); err == nil {
+			return line.date, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testHeader = `"remotehost","rfc931","authuser","date","request","status","bytes"` + "\n"
+
+func writeGzip(t *testing.T, path string, data string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := gzip.NewWriter(f)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpandInputs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"access.log", "access.log.1", "access.log.2.gz", "error.log"} {
+		appendFile(t, filepath.Join(dir, name), "")
+	}
+
+	var tests = []struct {
+		input []string
+		want  []string
+		fail  bool
+	}{
+		{[]string{"-"}, []string{"-"}, false},
+		{[]string{filepath.Join(dir, "access.log*")},
+			[]string{filepath.Join(dir, "access.log"), filepath.Join(dir, "access.log.1"), filepath.Join(dir, "access.log.2.gz")}, false},
+		{[]string{filepath.Join(dir, "error.log"), filepath.Join(dir, "*.log")},
+			[]string{filepath.Join(dir, "error.log"), filepath.Join(dir, "access.log")}, false},
+		{[]string{"-", filepath.Join(dir, "error.log")}, nil, true},
+		{[]string{filepath.Join(dir, "missing.log")}, nil, true},
+		{[]string{"[", "-"}, nil, true},
+	}
+	for _, test := range tests {
+		got, err := ExpandInputs(test.input)
+		if test.fail {
+			if err == nil {
+				t.Errorf(`ExpandInputs(%q) returned no error`, test.input)
+			}
+		} else if err != nil || !cmp.Equal(got, test.want) {
+			t.Errorf(`ExpandInputs(%q) returned %q, %v, want %q`, test.input, got, err, test.want)
+		}
+	}
+}
+
+func TestReadMultipleInputs(t *testing.T) {
+	dir := t.TempDir()
+	latest := filepath.Join(dir, "access.log")
+	earliest := filepath.Join(dir, "access.log.2.gz")
+	middle := filepath.Join(dir, "access.log.1")
+
+	appendFile(t, latest, testHeader+`"10.0.0.1","-","apache",1549573880,"GET /c HTTP/1.0",200,1`+"\n")
+	appendFile(t, middle, testHeader+`"10.0.0.1","-","apache",1549573870,"GET /b HTTP/1.0",200,1`+"\n")
+	writeGzip(t, earliest, testHeader+`"10.0.0.1","-","apache",1549573860,"GET /a HTTP/1.0",200,1`+"\n")
+
+	r := NewReader("")
+	r.inputs = []string{latest, earliest, middle}
+	out := make(chan LogModel)
+	go r.Process(out)
+
+	var got []string
+	for line := range out {
+		got = append(got, line.section)
+	}
+	if want := []string{"/a", "/b", "/c"}; !cmp.Equal(got, want) {
+		t.Errorf(`Reader read sections %q, want %q`, got, want)
+	}
+}
+
+func TestReadOverlappingInputs(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "worker1.log")
+	second := filepath.Join(dir, "worker2.log")
+	firstLog, secondLog := testHeader, testHeader
+	for _, date := range []int64{1549573860, 1549573862, 1549573864} {
+		firstLog += fmt.Sprintf(`"10.0.0.1","-","apache",%v,"GET /a HTTP/1.0",200,1`+"\n", date)
+		secondLog += fmt.Sprintf(`"10.0.0.1","-","apache",%v,"GET /b HTTP/1.0",200,1`+"\n", date+1)
+	}
+	appendFile(t, first, firstLog)
+	appendFile(t, second, secondLog)
+
+	r := NewReader("")
+	r.inputs = []string{first, second}
+	r.lateness = 0
+	out := make(chan LogModel)
+	go r.Process(out)
+
+	// The files are merged line by line, so no line is too late.
+	var got []int64
+	for line := range out {
+		got = append(got, line.date-1549573860)
+	}
+	if want := []int64{0, 1, 2, 3, 4, 5}; !cmp.Equal(got, want) {
+		t.Errorf(`Reader read lines at %v, want %v`, got, want)
+	}
+}
+
+func TestReadFollowFromEnd(t *testing.T) {
+	dir := t.TempDir()
+	latest := filepath.Join(dir, "access.log")
+	earlier := filepath.Join(dir, "access.log.1")
+	appendFile(t, latest, testHeader+`"10.0.0.1","-","apache",1549573870,"GET /b HTTP/1.0",200,1`+"\n")
+	appendFile(t, earlier, testHeader+`"10.0.0.1","-","apache",1549573860,"GET /a HTTP/1.0",200,1`+"\n")
+
+	r := NewReader("")
+	r.inputs = []string{latest, earlier}
+	r.follow = true
+	out := make(chan LogModel)
+	go r.Process(out)
+
+	// Only lines appended to the latest file are read, using the columns of its header. The
+	// second line moves the reorder buffer's watermark past the first.
+	time.Sleep(100 * time.Millisecond)
+	appendFile(t, latest, `"10.0.0.1","-","apache",1549573880,"GET /c HTTP/1.0",200,1`+"\n"+
+		`"10.0.0.1","-","apache",1549573890,"GET /d HTTP/1.0",200,1`+"\n")
+	select {
+	case line := <-out:
+		if line.section != "/c" {
+			t.Errorf(`Followed reader read section %q first, want "/c"`, line.section)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf(`Followed reader did not read the appended lines`)
+	}
+}
+
+func TestOrderInputs(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.log")
+	later := filepath.Join(dir, "later.log")
+	earlier := filepath.Join(dir, "earlier.log")
+	appendFile(t, empty, testHeader)
+	appendFile(t, later, testHeader+`"10.0.0.1","-","apache",1549573870,"GET /b HTTP/1.0",200,1`+"\n")
+	appendFile(t, earlier, testHeader+`"10.0.0.1","-","apache",1549573860,"GET /a HTTP/1.0",200,1`+"\n")
+
+	newParser := func() Parser { return NewCSVParser() }
+	got := orderInputs([]string{empty, later, earlier}, newParser)
+	if want := []string{earlier, later, empty}; !cmp.Equal(got, want) {
+		t.Errorf(`orderInputs returned %q, want %q`, got, want)
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	var tests = []struct {
+		input   string
+		name    string
+		pattern string
+	}{
+		{"web1=/var/log/access.log*", "web1", "/var/log/access.log*"},
+		{"/var/log/web2/access.log", "access.log", "/var/log/web2/access.log"},
+		{"-", "stdin", "-"},
+		{"web3=-", "web3", "-"},
+		{"/var/log/a=b.log", "a=b.log", "/var/log/a=b.log"},
+	}
+	for _, test := range tests {
+		name, pattern := ParseSource(test.input)
+		if name != test.name || pattern != test.pattern {
+			t.Errorf(`ParseSource(%q) returned %q, %q, want %q, %q`, test.input, name, pattern, test.name, test.pattern)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+/*
+`JSONSink` writes each stats report and alert as a single JSON object on a line of its own, so
+that the output can be ingested by log shippers and tools such as jq without parsing the
+coloured text. Each object has a `type` of `stats` or `alert` and a `timestamp` in seconds since
+the epoch. A stats event holds the full list of top sections and of each ranking, and an alert
+event holds the rule, its state and severity, the value compared with the threshold and the
+number of requests in the window.
+*/
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// JSONSink writes stats reports and alerts as JSON lines.
+type JSONSink struct {
+	encoder *json.Encoder
+	closer  io.Closer
+}
+
+// NewJSONSink returns a Sink which writes JSON lines to out.
+func NewJSONSink(out io.Writer) *JSONSink {
+	return &JSONSink{encoder: json.NewEncoder(out)}
+}
+
+type topKEvent struct {
+	Key   string `json:"key"`
+	Hits  int    `json:"hits"`
+	Bytes int64  `json:"bytes"`
+	Error int    `json:"error,omitempty"` // maximum overestimate of hits of an approximate ranking
+}
+
+type rankingEvent struct {
+	Name    string      `json:"name"`
+	Results []topKEvent `json:"results"`
+}
+
+type latencyEvent struct {
+	Key   string  `json:"key,omitempty"`
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+type statsEvent struct {
+	Type             string         `json:"type"`
+	Timestamp        int64          `json:"timestamp"`
+	Source           string         `json:"source,omitempty"`
+	Sections         []topKEvent    `json:"sections"`
+	Bytes            int64          `json:"bytes"`
+	Rankings         []rankingEvent `json:"rankings"`
+	SectionLatencies []latencyEvent `json:"section_latencies,omitempty"`
+	Latency          *latencyEvent  `json:"latency,omitempty"` // omitted if no request has a request time
+}
+
+type alertEvent struct {
+	Type        string   `json:"type"`
+	Timestamp   int64    `json:"timestamp"`
+	Rule        string   `json:"rule"`
+	Description string   `json:"description"`
+	Key         string   `json:"key,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	State       string   `json:"state"`
+	Severity    string   `json:"severity"`
+	Escalated   bool     `json:"escalated,omitempty"`
+	Metric      string   `json:"metric"`
+	Value       float64  `json:"value"`
+	Hits        int      `json:"hits"`
+	Threshold   float64  `json:"threshold"`
+	Window      int      `json:"window"`
+	Expected    *float64 `json:"expected,omitempty"` // omitted for a fixed threshold
+}
+
+// alertStateNames are the names of alert states in JSON events.
+var alertStateNames = map[AlertState]string{
+	AlertNone:     "recovered",
+	AlertFiring:   "firing",
+	AlertFlapping: "flapping",
+}
+
+// Stats writes a stats report as a JSON line.
+func (s *JSONSink) Stats(report StatsReport) error {
+	event := statsEvent{
+		Type:      "stats",
+		Timestamp: report.tick,
+		Source:    report.source,
+		Sections:  newTopKEvents(report.sections),
+		Bytes:     report.bytes,
+		Rankings:  []rankingEvent{},
+	}
+	for _, ranking := range report.rankings {
+		event.Rankings = append(event.Rankings, rankingEvent{ranking.name, newTopKEvents(ranking.results)})
+	}
+	if report.latency.count > 0 {
+		for _, latency := range report.sectionLatencies {
+			event.SectionLatencies = append(event.SectionLatencies, newLatencyEvent(latency))
+		}
+		latency := newLatencyEvent(report.latency)
+		event.Latency = &latency
+	}
+	return s.encoder.Encode(event)
+}
+
+// Alert writes an alert as a JSON line.
+func (s *JSONSink) Alert(alert Alert) error {
+	return s.encoder.Encode(newAlertEvent(alert))
+}
+
+// Close closes the file written to, if any.
+func (s *JSONSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// newAlertEvent returns the JSON event of an alert.
+func newAlertEvent(alert Alert) alertEvent {
+	event := alertEvent{
+		Type:        "alert",
+		Timestamp:   alert.time,
+		Rule:        alert.rule,
+		Description: alert.description,
+		Key:         alert.key,
+		Source:      alert.source,
+		State:       alertStateNames[alert.state],
+		Severity:    alert.severity.String(),
+		Escalated:   alert.escalated,
+		Metric:      alert.metric,
+		Value:       alert.value,
+		Hits:        alert.hits,
+		Threshold:   alert.threshold,
+		Window:      alert.window,
+	}
+	if len(alert.baseline) > 0 {
+		event.Expected = &alert.expected
+	}
+	return event
+}
+
+// newTopKEvents returns the JSON events of a top k list, which is empty rather than null if
+// there are no results.
+func newTopKEvents(results []TopKResult) []topKEvent {
+	events := make([]topKEvent, len(results))
+	for index, result := range results {
+		events[index] = topKEvent{result.key, result.hits, result.bytes, result.error}
+	}
+	return events
+}
+
+// newLatencyEvent returns the JSON event of a latency result.
+func newLatencyEvent(latency LatencyResult) latencyEvent {
+	return latencyEvent{latency.key, latency.count, latency.p50, latency.p90, latency.p99, latency.max}
+}
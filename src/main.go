@@ -1,7 +1,8 @@
 /*
-http-log-monitor is a Go HTTP log monitoring console programme. It is able to read CSV-encoded
-HTTP access logs, display the most popular endpoint sections over a specified time period, and
-alert when traffic passes a certain threshold across a given time period.
+http-log-monitor is a Go HTTP log monitoring console programme. It is able to read CSV-encoded,
+Common Log Format, Combined Log Format and JSON-lines HTTP access logs, display the most popular
+endpoint sections over a specified time period, and alert when traffic passes a certain threshold
+across a given time period.
 */
 package main
 
@@ -9,19 +10,273 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
-var filePath = flag.String("input", "", "input log file path (required)")
-var statsInterval = flag.Int("stats", 10, "time interval between displaying stats in seconds")
-var monitorWindow = flag.Int("alert", 120, "duration of the high traffic alert window in seconds")
-var monitorRps = flag.Int("rps", 10, "average requests per second threshold for high traffic alert")
+// stringList is a flag which may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var defaults = DefaultConfig()
+
+var configPath = flag.String("config", "", "JSON config file, flags override values in the file")
+var inputPatterns stringList
+var ruleSpecs stringList
+var dimensionSpecs stringList
+var statsInterval = flag.Int("stats", defaults.Stats.Interval, "time interval between displaying stats in seconds")
+var statsTopK = flag.Int("top", defaults.Stats.TopK, "number of sections to display in stats")
+var statsTopHosts = flag.Int("top-hosts", defaults.Stats.TopHosts, "number of client hosts to display in stats, 0 to disable")
+var statsTopUsers = flag.Int("top-users", defaults.Stats.TopUsers, "number of users to display in stats, 0 to disable")
+var statsTopStatus = flag.Int("top-status", defaults.Stats.TopStatus, "number of status codes to display in stats, 0 to disable")
+var statsTopMethods = flag.Int("top-methods", defaults.Stats.TopMethods, "number of HTTP methods to display in stats, 0 to disable")
+var monitorWindow = flag.Int("alert", defaults.Alert.Window, "duration of the high traffic alert window in seconds")
+var monitorRps = flag.Int("rps", defaults.Alert.Rps, "average requests per second threshold for high traffic alert")
+var recoverRps = flag.Int("recover-rps", defaults.Alert.RecoverRps, "average requests per second the high traffic alert recovers below, 0 for -rps")
+var criticalRps = flag.Int("critical-rps", defaults.Alert.CriticalRps, "average requests per second at which the high traffic alert is critical, 0 for -rps")
+var alertFor = flag.Int("for", defaults.Alert.For, "seconds an alert threshold must be passed before the alert fires")
+var recoverFor = flag.Int("recover-for", defaults.Alert.RecoverFor, "seconds an alert recover threshold must be passed before the alert recovers")
+var flapLimit = flag.Int("flap-limit", defaults.Alert.FlapLimit, "changes of an alert's state within 10 minutes above which its alerts are suppressed, 0 to disable")
+var minRps = flag.Float64("min-rps", defaults.Alert.MinRps, "average requests per second floor for low traffic alert, 0 to disable")
+var warmup = flag.Int("warmup", defaults.Alert.Warmup, "seconds after startup before a low traffic alert, 0 for the alert window")
+var monitorBps = flag.Int64("bps", defaults.Alert.Bps, "average bytes per second threshold for high bandwidth alert, 0 to disable")
+var sectionRps = flag.Int("section-rps", defaults.Alert.SectionRps, "average requests per second threshold for high traffic to a single section, 0 to disable")
+var sectionBy = flag.String("section-by", defaults.Alert.SectionBy, "attribute for -section-rps: section or endpoint")
+var errorRate = flag.Float64("error-rate", defaults.Alert.ErrorRate, "percentage of 5xx responses within the alert window to alert at, 0 to disable")
+var clientErrorRate = flag.Float64("client-error-rate", defaults.Alert.ClientErrorRate, "percentage of 4xx responses within the alert window to alert at, 0 to disable")
+var minRequests = flag.Int("min-requests", defaults.Alert.MinRequests, "number of requests within the alert window needed before an error rate alert")
+var latency = flag.Duration("latency", defaults.Alert.Latency.Duration, "latency percentile threshold for high latency alert, e.g. 500ms, 0 to disable")
+var latencyPercentile = flag.Float64("latency-percentile", defaults.Alert.LatencyPercentile, "percentile of request times compared against -latency")
+var anomaly = flag.Float64("anomaly", defaults.Alert.Anomaly, "standard deviations from the learned baseline of requests within the alert window to alert at, for spikes and drops, 0 to disable")
+var baseline = flag.String("baseline", defaults.Alert.Baseline, "baseline learned for -anomaly: ewma, or daily to learn each hour of the day separately")
+var format = flag.String("format", defaults.Format, "input log format: csv, clf, combined or json")
+var jsonFieldMapping = flag.String("fields", "", "comma separated JSON key to field mapping for json input, e.g. ts=date,path=endpoint")
+var perSource = flag.Bool("per-source", defaults.PerSource, "also report stats and alerts for each named -input source")
+var follow = flag.Bool("follow", defaults.Follow, "keep reading the input file as it grows, surviving log rotation")
+var fromStart = flag.Bool("from-start", defaults.FromStart, "with -follow, read the inputs from the start rather than only lines appended from now on")
+var maxLateness = flag.Duration("max-lateness", defaults.MaxLateness.Duration, "how late an out of order log line may arrive before it is dropped")
+var reorderCapacity = flag.Int("reorder-capacity", defaults.ReorderCapacity, "maximum number of log lines held for reordering")
+var rejectsPath = flag.String("rejects", defaults.Rejects, "file to write malformed log lines to")
+var output = flag.String("output", defaults.Output, "format of stats and alerts: text, or json for one JSON object per line")
+var outputFile = flag.String("output-file", defaults.OutputFile, "file to also write stats and alerts to")
+var webhookURL = flag.String("webhook", defaults.Webhook.URL, "URL to POST alerts to")
+var webhookTemplate = flag.String("webhook-template", defaults.Webhook.Template, "Go template of the webhook request body, empty for a JSON object")
+var webhookTimeout = flag.Duration("webhook-timeout", defaults.Webhook.Timeout.Duration, "timeout of each webhook request")
+var webhookRetries = flag.Int("webhook-retries", defaults.Webhook.Retries, "retries of a failed webhook request, each with a doubled delay, before the failure is reported")
+var webhookBackoff = flag.Duration("webhook-backoff", defaults.Webhook.Backoff.Duration, "delay before the first webhook retry, doubling with each retry up to 10m")
+var webhookQueue = flag.String("webhook-queue", defaults.Webhook.Queue, "file undelivered webhook alerts are saved to, to be sent after a restart")
+var strict = flag.Bool("strict", defaults.Strict, "stop on the first log line which cannot be read or parsed")
+var realtime = flag.Bool("realtime", defaults.Realtime, "move time forward with the system clock rather than log timestamps")
+var realtimeDelay = flag.Int("delay", defaults.Delay, "seconds the real-time clock waits for late log lines")
 
 func main() {
+	flag.Var(&inputPatterns, "input", "input log file path, glob pattern or - for stdin, optionally prefixed with name=, may be repeated (required)")
+	flag.Var(&dimensionSpecs, "dimension", "additional stats ranking as name=key, where key is attributes joined by +, optionally followed by :k and :capacity, may be repeated")
+	flag.Var(&ruleSpecs, "rule", "additional alert rule as comma separated key=value pairs, may be repeated")
 	flag.Parse()
-	if len(*filePath) == 0 {
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v.\n", err)
+		return
+	}
+	if len(config.Inputs) == 0 {
 		fmt.Fprint(os.Stderr, "No input file path provided. Use -input to specify one.\n")
 		return
 	}
-	player := NewPlayer(*filePath, int64(*statsInterval), *monitorRps, *monitorWindow)
+	player, err := NewPlayerFromConfig(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v.\n", err)
+		return
+	}
+	done := make(chan struct{})
+	if len(*configPath) > 0 {
+		player.reloads = make(chan Config)
+		go reloadOnHangup(config, player.reloads, done)
+	}
+	go stopOnInterrupt(player)
 	player.Play()
+	close(done)
+	if err := player.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to close output: %v.\n", err)
+	}
+}
+
+// stopOnInterrupt stops the player when SIGINT or SIGTERM is received, so that its outputs are
+// written and closed before exiting. A second signal exits immediately.
+func stopOnInterrupt(player *Player) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	<-interrupt
+	signal.Stop(interrupt)
+	player.Stop()
+}
+
+// reloadOnHangup reads the config again each time SIGHUP is received and sends it to be
+// applied, until done is closed as the Player has stopped playing.
+func reloadOnHangup(running Config, reloads chan Config, done chan struct{}) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-hangup:
+		case <-done:
+			return
+		}
+		config, err := loadConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Config not reloaded: %v.\n", err)
+			continue
+		}
+		if names := running.RestartSettings(config); len(names) > 0 {
+			fmt.Fprintf(os.Stderr, "Changes to %s are ignored until restart.\n", strings.Join(names, ", "))
+		}
+		select {
+		case reloads <- config:
+		case <-done:
+			return
+		}
+	}
+}
+
+// loadConfig reads the config file, if one is given, and overrides its values with any flags
+// which are set.
+func loadConfig() (Config, error) {
+	config := DefaultConfig()
+	if len(*configPath) > 0 {
+		var err error
+		if config, err = LoadConfig(*configPath); err != nil {
+			return config, err
+		}
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "input":
+			config.Inputs = inputPatterns
+		case "rule":
+			for _, spec := range ruleSpecs {
+				rule, ruleErr := ParseRule(spec)
+				if ruleErr != nil {
+					err = fmt.Errorf("-rule: %v", ruleErr)
+					return
+				}
+				config.SetRule(rule)
+			}
+		case "dimension":
+			for _, spec := range dimensionSpecs {
+				dimension, dimensionErr := ParseDimension(spec)
+				if dimensionErr != nil {
+					err = fmt.Errorf("-dimension: %v", dimensionErr)
+					return
+				}
+				config.Stats.SetDimension(dimension)
+			}
+		case "stats":
+			config.Stats.Interval = *statsInterval
+		case "top":
+			config.Stats.TopK = *statsTopK
+		case "top-hosts":
+			config.Stats.TopHosts = *statsTopHosts
+		case "top-users":
+			config.Stats.TopUsers = *statsTopUsers
+		case "top-status":
+			config.Stats.TopStatus = *statsTopStatus
+		case "top-methods":
+			config.Stats.TopMethods = *statsTopMethods
+		case "alert":
+			config.Alert.Window = *monitorWindow
+		case "rps":
+			config.Alert.Rps = *monitorRps
+		case "recover-rps":
+			config.Alert.RecoverRps = *recoverRps
+		case "critical-rps":
+			config.Alert.CriticalRps = *criticalRps
+		case "for":
+			config.Alert.For = *alertFor
+		case "recover-for":
+			config.Alert.RecoverFor = *recoverFor
+		case "flap-limit":
+			config.Alert.FlapLimit = *flapLimit
+		case "min-rps":
+			config.Alert.MinRps = *minRps
+		case "warmup":
+			config.Alert.Warmup = *warmup
+		case "bps":
+			config.Alert.Bps = *monitorBps
+		case "section-rps":
+			config.Alert.SectionRps = *sectionRps
+		case "section-by":
+			config.Alert.SectionBy = *sectionBy
+		case "error-rate":
+			config.Alert.ErrorRate = *errorRate
+		case "client-error-rate":
+			config.Alert.ClientErrorRate = *clientErrorRate
+		case "min-requests":
+			config.Alert.MinRequests = *minRequests
+		case "latency":
+			config.Alert.Latency.Duration = *latency
+		case "latency-percentile":
+			config.Alert.LatencyPercentile = *latencyPercentile
+		case "anomaly":
+			config.Alert.Anomaly = *anomaly
+		case "baseline":
+			config.Alert.Baseline = *baseline
+		case "format":
+			config.Format = *format
+		case "fields":
+			fields, fieldsErr := ParseFieldMapping(*jsonFieldMapping)
+			if fieldsErr != nil {
+				err = fmt.Errorf("-fields: %v", fieldsErr)
+				return
+			}
+			config.Fields = fields
+		case "per-source":
+			config.PerSource = *perSource
+		case "follow":
+			config.Follow = *follow
+		case "from-start":
+			config.FromStart = *fromStart
+		case "max-lateness":
+			config.MaxLateness.Duration = *maxLateness
+		case "reorder-capacity":
+			config.ReorderCapacity = *reorderCapacity
+		case "webhook":
+			config.Webhook.URL = *webhookURL
+		case "webhook-template":
+			config.Webhook.Template = *webhookTemplate
+		case "webhook-timeout":
+			config.Webhook.Timeout.Duration = *webhookTimeout
+		case "webhook-retries":
+			config.Webhook.Retries = *webhookRetries
+		case "webhook-backoff":
+			config.Webhook.Backoff.Duration = *webhookBackoff
+		case "webhook-queue":
+			config.Webhook.Queue = *webhookQueue
+		case "output":
+			config.Output = *output
+		case "output-file":
+			config.OutputFile = *outputFile
+		case "rejects":
+			config.Rejects = *rejectsPath
+		case "strict":
+			config.Strict = *strict
+		case "realtime":
+			config.Realtime = *realtime
+		case "delay":
+			config.Delay = *realtimeDelay
+		}
+	})
+	return config, err
 }
@@ -0,0 +1,63 @@
+/*
+`Merger` combines the output of several `Reader`s, such as the access logs of each node in a
+cluster, into a single time ordered stream. Each `Reader` runs concurrently and produces lines
+in timestamp order. A k-way merge is performed using the `PriorityQueue`, which holds the next
+line from each `Reader` with the earliest timestamp at the front. When the front line is sent
+it is replaced by the next line from the same `Reader`, so the queue never holds more than one
+line per source. The merge must wait for every `Reader` to produce a line before sending. A
+`Reader` driven by a clock, in real-time mode or when following a log from its end, therefore
+also produces a heartbeat each second: a watermark promising that no earlier line will follow.
+A heartbeat takes its source's place in the queue like a line, so the front of the queue is
+released once every source's line or watermark has passed it, and a quiet source does not hold
+back the others. Heartbeats are passed on, so that a merge may itself be merged.
+*/
+package main
+
+import "container/heap"
+
+// LogSource produces a time ordered stream of log lines, which may include heartbeats.
+type LogSource interface {
+	Process(out chan LogModel)
+}
+
+type Merger struct {
+	readers []LogSource
+}
+
+// mergeEntry is a line held in the merge queue along with the index of its source.
+type mergeEntry struct {
+	line   LogModel
+	source int
+}
+
+// NewMerger returns a new instance of the Merger.
+func NewMerger(readers []LogSource) *Merger {
+	return &Merger{readers: readers}
+}
+
+// Process starts each reader and outputs their combined lines in timestamp order to the out
+// channel. The out channel is closed once every reader is finished.
+func (m *Merger) Process(out chan LogModel) {
+	inputs := make([]chan LogModel, len(m.readers))
+	for i, reader := range m.readers {
+		inputs[i] = make(chan LogModel, defaultBufferSize)
+		go reader.Process(inputs[i])
+	}
+
+	queue := make(PriorityQueue, 0, len(inputs))
+	next := func(source int) {
+		if line, ok := <-inputs[source]; ok {
+			heap.Push(&queue, &LogItem{value: mergeEntry{line, source}, priority: line.date})
+		}
+	}
+	for i := range inputs {
+		next(i)
+	}
+
+	for queue.Len() > 0 {
+		entry := heap.Pop(&queue).(*LogItem).value.(mergeEntry)
+		out <- entry.line
+		next(entry.source)
+	}
+	close(out)
+}
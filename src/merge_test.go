@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// sliceSource is a LogSource which outputs a fixed list of lines.
+type sliceSource []LogModel
+
+func (s sliceSource) Process(out chan LogModel) {
+	for _, line := range s {
+		out <- line
+	}
+	close(out)
+}
+
+// quietSource is a LogSource which outputs a list of lines and heartbeats, then stays open
+// until released.
+type quietSource struct {
+	lines   []LogModel
+	release chan bool
+}
+
+func (s quietSource) Process(out chan LogModel) {
+	for _, line := range s.lines {
+		out <- line
+	}
+	<-s.release
+	close(out)
+}
+
+func TestMergerHeartbeat(t *testing.T) {
+	quiet := quietSource{[]LogModel{{date: 2, heartbeat: true}, {date: 6, heartbeat: true}}, make(chan bool)}
+	m := NewMerger([]LogSource{
+		sliceSource{{date: 1, source: "a"}, {date: 5, source: "a"}, {date: 7, source: "a"}},
+		quiet,
+	})
+	out := make(chan LogModel)
+	go m.Process(out)
+
+	// Lines up to the quiet source's last heartbeat are sent although it has no next line.
+	var got []int64
+	for len(got) < 2 {
+		select {
+		case line := <-out:
+			if !line.heartbeat {
+				got = append(got, line.date)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf(`Merger sent lines %v, then waited for the quiet source`, got)
+		}
+	}
+	close(quiet.release)
+	for line := range out {
+		if !line.heartbeat {
+			got = append(got, line.date)
+		}
+	}
+	if len(got) != 3 || got[0] != 1 || got[1] != 5 || got[2] != 7 {
+		t.Errorf(`Merger sent lines %v, want [1 5 7]`, got)
+	}
+}
+
+func TestMerger(t *testing.T) {
+	m := NewMerger([]LogSource{
+		sliceSource{{date: 1, source: "a"}, {date: 4, source: "a"}, {date: 4, source: "a"}, {date: 9, source: "a"}},
+		sliceSource{},
+		sliceSource{{date: 2, source: "b"}, {date: 3, source: "b"}, {date: 10, source: "b"}},
+		sliceSource{{date: 1, source: "c"}, {date: 5, source: "c"}},
+	})
+	out := make(chan LogModel)
+	go m.Process(out)
+
+	count := make(map[string]int)
+	prevTime := int64(0)
+	for line := range out {
+		if line.date < prevTime {
+			t.Errorf(`Merger out of order. Previous time %v, got %v`, prevTime, line.date)
+		}
+		prevTime = line.date
+		count[line.source]++
+	}
+
+	want := map[string]int{"a": 4, "b": 3, "c": 2}
+	for source, n := range want {
+		if count[source] != n {
+			t.Errorf(`Merger output %v lines from source %q, want %v`, count[source], source, n)
+		}
+	}
+}
@@ -1,10 +1,35 @@
 /*
-`Monitor` is responsible for high traffic and recovery alerts. It is initialised with
-a duration and average request per second value. A FIFO queue is used of size duration where
-each entry holds the number of hits for a second of time. As time ticks forward the number
-of hits for this second are appended to the end. Once the queue reaches capacity, subsequent
-appends cause the front entry to be popped. This allows the total number of hits for the
-chosen duration to be efficiently maintained.
+`Monitor` is responsible for alerts and recoveries. It evaluates a set of `Rule`s, each with
+its own duration, metric and threshold. For each rule a FIFO queue is used of size duration
+where each entry holds the metric, such as the number of hits, for a second of time. As time
+ticks forward the value for this second is appended to the end. Once the queue reaches capacity,
+subsequent appends cause the front entry to be popped. This allows the total for the chosen
+duration to be efficiently maintained. A rule which groups lines by an attribute keeps a
+separate queue, and alert state, for each value of the attribute. To bound memory a rule keeps
+at most its max_groups queues, and the queue of a group with no requests for the whole window is
+evicted once it is not alerting. Each entry also holds the number of requests in the second, so
+that an error rate can be found from the window totals. For a latency rule each entry holds a
+`LatencySketch` of the second's request times, which is merged into the window's sketch when
+pushed and subtracted from it when popped.
+
+A rule with a baseline keeps a `Baseline` for each window, which learns the window total on each
+tick once the window is full. The total is compared with the mean learned so far, and the
+baseline does not learn while the window is alerting, so that an anomaly does not become the
+new normal before it has recovered.
+
+An alert changes state once the rule's threshold, or recover threshold when firing, has been
+passed for the rule's for or recover_for duration. Each window remembers when its alert changed
+state within the flap window, and while there are more changes than the flap limit the alerts
+are suppressed, with a single message when the window starts and stops flapping.
+
+A rule which is not grouped has its window from the start, rather than from its first matching
+line, so that a rule alerting on low traffic fires even if no line ever arrives.
+
+An alert of a rule with a critical threshold moves between warning and critical as the total
+passes the critical threshold, and each change of severity is sent as an alert of its own.
+
+The rules can be replaced while the monitor is running. A rule which keeps its name keeps its
+window history and alert state, unless the lines it counts have changed.
 */
 package main
 
@@ -12,84 +37,414 @@ import (
 	"container/list"
 	"fmt"
 	"os"
+	"reflect"
+	"sort"
 )
 
 type AlertState int
 
 const (
 	AlertNone AlertState = iota
-	AlertTraffic
+	AlertFiring
+	AlertFlapping
 )
 
+// Alert is a change in the alert state of a rule.
+type Alert struct {
+	rule        string     // name of the rule
+	description string     // description of the rule
+	key         string     // value of the rule's group attribute, empty if not grouped
+	source      string     // source being monitored, empty for all sources
+	state       AlertState // new alert state, or flapping when alerts are suppressed
+	severity    Severity   // severity of the alert, or of the alert which recovered
+	escalated   bool       // the severity of a firing alert changed
+	metric      string     // metric totalled by the rule
+	value       float64    // total over the window, or percentage for an error rate
+	hits        int        // number of requests matching the rule in the window
+	threshold   float64    // threshold for the total over the window
+	window      int        // duration of the window in seconds
+	time        int64      // time of the change
+	baseline    string     // baseline of the rule, empty for a fixed threshold
+	expected    float64    // mean learned by the baseline
+}
+
 type Monitor struct {
-	queue     *list.List
-	capacity  int
-	tickHits  int
-	totalHits int
-	threshold int
-	alert     AlertState
-	tick      int64
+	name  string // source being monitored, empty for all sources
+	sink  Sink   // receives alerts, nil to discard them
+	rules []*ruleState
+	tick  int64
+	start int64 // time the monitor was synchronised, from which rules warm up
+}
+
+// ruleState holds the windows of a rule, one for each group.
+type ruleState struct {
+	rule   Rule
+	groups map[string]*window
+	full   bool // the rule has reported that it has reached its maximum number of groups
+}
+
+// window is a sliding window of per second totals.
+type window struct {
+	queue    *list.List
+	capacity int
+	current  sample // total for the current second
+	total    sample // total over the window
+	alert    AlertState
+	severity Severity  // severity of the alert while firing, kept once it recovers
+	baseline *Baseline // learned total, nil for a fixed threshold
+	pending  bool      // the condition to change the alert's state holds
+	since    int64     // time the condition to change the alert's state began to hold
+	changes  []int64   // times the alert's state changed within the flap window
+	flapping bool      // alerts are suppressed as the state changes too often
+}
+
+// newWindow returns an empty window for a rule.
+func newWindow(rule Rule) *window {
+	// The rule has been validated, so its baseline is valid.
+	baseline, _ := rule.newBaseline()
+	return &window{queue: list.New(), capacity: rule.Window, baseline: baseline}
+}
+
+// sample is the total of a rule's metric, and the number of requests it was measured over.
+type sample struct {
+	value    float64
+	requests float64
+	latency  *LatencySketch // request times of a latency rule, nil for other metrics
+}
+
+// add returns the sum of two samples. The sample's sketch is updated in place, so it must not
+// be shared.
+func (s sample) add(other sample) sample {
+	if other.latency != nil {
+		if s.latency == nil {
+			s.latency = NewLatencySketch()
+		}
+		s.latency.Merge(other.latency)
+	}
+	return sample{s.value + other.value, s.requests + other.requests, s.latency}
+}
+
+// sub returns the difference of two samples. The sample's sketch is updated in place.
+func (s sample) sub(other sample) sample {
+	if other.latency != nil && s.latency != nil {
+		s.latency.Subtract(other.latency)
+	}
+	return sample{s.value - other.value, s.requests - other.requests, s.latency}
 }
 
-// NewMonitor returns a new instance of the Monitor.
+// addLatency records a request time in the sample's sketch.
+func (s *sample) addLatency(latency float64) {
+	if s.latency == nil {
+		s.latency = NewLatencySketch()
+	}
+	s.latency.Add(latency)
+}
+
+// NewMonitor returns a new instance of the Monitor with a high traffic rule.
 func NewMonitor(rps int, window int) *Monitor {
-	return &Monitor{
-		queue:     list.New(),
-		capacity:  window,
-		threshold: rps * window,
-		alert:     AlertNone,
+	m := &Monitor{}
+	m.AddRule(HighTrafficRule(rps, window))
+	return m
+}
+
+// NewRuleMonitor returns a new instance of the Monitor which evaluates the given rules.
+func NewRuleMonitor(rules []Rule) (*Monitor, error) {
+	m := &Monitor{}
+	for _, rule := range rules {
+		if err := m.AddRule(rule); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// AddRule adds a rule to be evaluated on each tick.
+func (m *Monitor) AddRule(rule Rule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	for _, state := range m.rules {
+		if state.rule.Name == rule.Name {
+			return fmt.Errorf("rule %q is defined more than once", rule.Name)
+		}
+	}
+	m.addRule(rule)
+	return nil
+}
+
+// addRule adds a rule which has already been validated.
+func (m *Monitor) addRule(rule Rule) {
+	state := &ruleState{rule: rule, groups: make(map[string]*window)}
+	if len(rule.GroupBy) == 0 {
+		state.groups[""] = newWindow(rule)
+	}
+	m.rules = append(m.rules, state)
+}
+
+// fresh returns a new Monitor which evaluates the same rules, as validated when they were added,
+// with no window history.
+func (m *Monitor) fresh() *Monitor {
+	fresh := &Monitor{}
+	for _, state := range m.rules {
+		fresh.addRule(state.rule)
+	}
+	return fresh
+}
+
+// SetRules replaces the rules evaluated by the monitor. Either every rule is applied or, if
+// any rule is invalid, none are. The history of a rule which is kept is resized to its new
+// window, and is discarded if the metric, filter or group of the rule has changed.
+func (m *Monitor) SetRules(rules []Rule) error {
+	updated, err := NewRuleMonitor(rules)
+	if err != nil {
+		return err
+	}
+	for _, state := range updated.rules {
+		for _, old := range m.rules {
+			if old.rule.Name != state.rule.Name || !sameLines(old.rule, state.rule) {
+				continue
+			}
+			state.groups = old.groups
+			for _, w := range state.groups {
+				w.resize(state.rule.Window)
+				if old.rule.Baseline != state.rule.Baseline || old.rule.HalfLife != state.rule.HalfLife {
+					w.baseline, _ = state.rule.newBaseline()
+				}
+			}
+		}
 	}
+	m.rules = updated.rules
+	return nil
+}
+
+// sameLines reports whether two rules total the same metric over the same lines.
+func sameLines(a Rule, b Rule) bool {
+	return a.Metric == b.Metric && a.GroupBy == b.GroupBy && a.statusClass() == b.statusClass() &&
+		reflect.DeepEqual(a.Filter, b.Filter)
 }
 
 // Sync synchronises the monitor's internal tick.
 func (m *Monitor) Sync(t int64) {
 	m.tick = t
+	m.start = t
 }
 
-// Hit registers a new hit in the current second.
-func (m *Monitor) Hit() {
-	m.tickHits++
+// Hit registers a new hit in the current second with each rule it matches.
+func (m *Monitor) Hit(line LogModel) {
+	for _, state := range m.rules {
+		if !state.rule.matches(line) {
+			continue
+		}
+		key := ""
+		if len(state.rule.GroupBy) > 0 {
+			key, _ = line.Attribute(state.rule.GroupBy)
+		}
+		w, found := state.groups[key]
+		if !found {
+			if len(state.groups) >= state.rule.maxGroups() {
+				if !state.full {
+					fmt.Fprintf(os.Stderr, "Rule %q has reached %v groups, new values of %s are not monitored until idle groups are evicted.\n",
+						state.rule.Name, state.rule.maxGroups(), state.rule.GroupBy)
+					state.full = true
+				}
+				continue
+			}
+			w = newWindow(state.rule)
+			state.groups[key] = w
+		}
+		w.current = w.current.add(sample{value: state.rule.measure(line), requests: 1})
+		if state.rule.Metric == MetricLatency {
+			w.current.addLatency(line.latency)
+		}
+	}
 }
 
-// Tick moves the monitor's internal tick forward. Hits during the last tick are added
-// to the queue. If the queue has reached capacity then the front element is removed.
+// Tick moves the monitor's internal tick forward. The total during the last tick is added
+// to each queue. If a queue has reached capacity then the front element is removed.
 func (m *Monitor) Tick(t int64) {
-	if m.queue.Len() == m.capacity {
-		front := m.queue.Front()
-		m.totalHits -= front.Value.(int)
-		m.queue.Remove(front)
+	m.tick = t
+	for _, state := range m.rules {
+		// Evaluate groups in a fixed order so that alerts are sent in a consistent order.
+		keys := make([]string, 0, len(state.groups))
+		for key := range state.groups {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			w := state.groups[key]
+			w.push()
+			m.checkAlerts(state.rule, key, w)
+			if len(state.rule.GroupBy) > 0 && w.idle() && w.alert == AlertNone && !w.flapping {
+				delete(state.groups, key)
+				state.full = false
+			}
+		}
 	}
+}
 
-	m.tick = t
-	m.queue.PushBack(m.tickHits)
-	m.totalHits += m.tickHits
-	m.tickHits = 0
-	m.checkAlerts()
-}
-
-// checkAlerts tests whether a new alert should be sent.
-func (m *Monitor) checkAlerts() {
-	if m.totalHits >= m.threshold && m.alert != AlertTraffic {
-		m.alert = AlertTraffic
-	} else if m.totalHits < m.threshold && m.alert == AlertTraffic {
-		m.alert = AlertNone
-	} else {
-		return
-	}
-	sendAlert(m.alert, m.totalHits, m.tick)
-}
-
-// sendAlert sends a new alert message based on the monitor's current alert state.
-var sendAlert = func(alert AlertState, hits int, alertTime int64) {
-	switch alert {
-	case AlertTraffic:
-		fmt.Print(ColourRed)
-		fmt.Printf("[ALERT]\t%v\tHigh traffic generated an alert - hits = %v\n", alertTime, hits)
-	case AlertNone:
-		fmt.Print(ColourGreen)
-		fmt.Printf("[ALERT]\t%v\tAlert recovered\n", alertTime)
+// idle reports whether the window has had no requests for its whole duration.
+func (w *window) idle() bool {
+	return w.queue.Len() == w.capacity && w.total.requests == 0
+}
+
+// push adds the total for the current second to the window.
+func (w *window) push() {
+	if w.queue.Len() == w.capacity {
+		front := w.queue.Front()
+		w.total = w.total.sub(front.Value.(sample))
+		w.queue.Remove(front)
+	}
+	w.queue.PushBack(w.current)
+	w.total = w.total.add(w.current)
+	w.current = sample{}
+}
+
+// resize changes the duration of the window, discarding the oldest seconds if it shrinks.
+func (w *window) resize(capacity int) {
+	for w.queue.Len() > capacity {
+		front := w.queue.Front()
+		w.total = w.total.sub(front.Value.(sample))
+		w.queue.Remove(front)
+	}
+	w.capacity = capacity
+}
+
+// checkAlerts tests whether a new alert should be sent for a rule's window.
+func (m *Monitor) checkAlerts(rule Rule, key string, w *window) {
+	value, compared := rule.evaluate(w.total)
+	if m.tick < m.start+int64(rule.warmup()) || (rule.below() && w.queue.Len() < w.capacity) {
+		compared = false
+	}
+	// Once firing, the alert holds until the recover threshold is passed back over.
+	threshold, sigma := rule.limit(), rule.Threshold
+	if w.alert == AlertFiring {
+		threshold, sigma = rule.recoverLimit(), rule.recoverThreshold()
+	}
+	passed, critical := false, false
+	criticalThreshold := 0.0
+	expected := 0.0
+	if w.baseline != nil {
+		mean, stddev, learned := w.baseline.Expected(m.tick)
+		if compared && learned {
+			passed, threshold = rule.deviates(value, mean, stddev, sigma)
+			if passed && rule.Critical > 0 {
+				critical, criticalThreshold = rule.deviates(value, mean, stddev, rule.Critical)
+			}
+		}
+		expected = mean
+		if compared && !passed && w.alert != AlertFiring && w.queue.Len() == w.capacity {
+			w.baseline.Learn(m.tick, value)
+		}
+	} else if compared {
+		passed, _ = compare(rule.Op, value, threshold)
+		if passed && rule.Critical > 0 {
+			criticalThreshold = rule.scale(rule.Critical)
+			critical, _ = compare(rule.Op, value, criticalThreshold)
+		}
+	}
+
+	state, severity := AlertNone, rule.Severity
+	if passed {
+		state = AlertFiring
+	}
+	if critical {
+		severity, threshold = SeverityCritical, criticalThreshold
+	}
+	previous, previousSeverity := w.alert, w.severity
+	changed := w.change(rule, state, severity, m.tick)
+	alert := Alert{
+		rule:        rule.Name,
+		description: rule.describe(),
+		key:         key,
+		source:      m.name,
+		state:       w.alert,
+		severity:    w.severity,
+		escalated:   previous == AlertFiring && w.alert == AlertFiring && previousSeverity != w.severity,
+		metric:      rule.Metric,
+		value:       value,
+		hits:        int(w.total.requests),
+		threshold:   threshold,
+		window:      rule.Window,
+		time:        m.tick,
+		baseline:    rule.Baseline,
+		expected:    expected,
+	}
+	if rule.FlapLimit > 0 {
+		if flapping := w.flap(rule, m.tick); flapping != w.flapping {
+			w.flapping = flapping
+			if flapping {
+				alert.state = AlertFlapping
+			}
+			alert.escalated = false
+			// Once the alert settles its current state is sent, even if it has not changed.
+			m.send(alert)
+			return
+		}
+	}
+	if changed && !w.flapping {
+		m.send(alert)
+	}
+}
+
+// send passes an alert to the monitor's sink.
+func (m *Monitor) send(alert Alert) {
+	if m.sink != nil {
+		m.sink.Alert(alert)
+	}
+}
+
+// change moves the window's alert towards the given state and severity, and reports whether it
+// changed. The alert must have differed from the given state for the rule's for duration to
+// fire or escalate, or recover_for duration to recover or return to a warning.
+func (w *window) change(rule Rule, state AlertState, severity Severity, t int64) bool {
+	if state == w.alert && (state != AlertFiring || severity == w.severity) {
+		w.pending = false
+		return false
+	}
+	if !w.pending {
+		w.pending = true
+		w.since = t
+	}
+	duration := rule.For
+	if w.alert == AlertFiring && (state != AlertFiring || severity < w.severity) {
+		duration = rule.RecoverFor
+	}
+	if t-w.since < int64(duration) {
+		return false
+	}
+	w.alert = state
+	if state == AlertFiring {
+		w.severity = severity
+	}
+	w.pending = false
+	if rule.FlapLimit > 0 {
+		w.changes = append(w.changes, t)
+	}
+	return true
+}
+
+// flap forgets the changes of state older than the rule's flap window and reports whether the
+// window is flapping.
+func (w *window) flap(rule Rule, t int64) bool {
+	start := 0
+	for start < len(w.changes) && w.changes[start] <= t-int64(rule.flapWindow()) {
+		start++
+	}
+	w.changes = w.changes[start:]
+	return len(w.changes) > rule.FlapLimit
+}
+
+// formatMetric formats the value of a metric for display.
+func formatMetric(metric string, value float64) string {
+	switch metric {
+	case MetricErrorRate:
+		return fmt.Sprintf("%.1f%%", value)
+	case MetricBytes:
+		return formatBytes(int64(value))
+	case MetricLatency:
+		return formatLatency(value)
 	default:
-		fmt.Fprintf(os.Stderr, "sendAlert unknown alert state: %v hits: %v time: %v \n", alert, hits, alertTime)
+		return fmt.Sprint(value)
 	}
-	fmt.Print(ColourReset)
 }
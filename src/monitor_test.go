@@ -1,10 +1,75 @@
 package main
 
 import (
+	"math"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
+// alertRecorder records the alerts sent by a monitor, and moves the monitor's time forward a
+// second at a time.
+type alertRecorder struct {
+	monitor *Monitor
+	time    int64 // current second of the monitor
+	alerts  []Alert
+}
+
+// recordAlerts records the alerts of a monitor whose current second is start.
+func recordAlerts(monitor *Monitor, start int64) *alertRecorder {
+	r := &alertRecorder{monitor: monitor, time: start}
+	monitor.sink = funcSink{alert: func(a Alert) { r.alerts = append(r.alerts, a) }}
+	return r
+}
+
+// tick registers the lines in the current second, then moves time forward a second.
+func (r *alertRecorder) tick(lines ...LogModel) {
+	for _, line := range lines {
+		r.monitor.Hit(line)
+	}
+	r.time++
+	r.monitor.Tick(r.time)
+}
+
+// hits registers each count of copies of the line in a second of its own.
+func (r *alertRecorder) hits(line LogModel, counts ...int) {
+	for _, n := range counts {
+		lines := make([]LogModel, n)
+		for index := range lines {
+			lines[index] = line
+		}
+		r.tick(lines...)
+	}
+}
+
+// repeat returns a count for each of the given number of seconds.
+func repeat(count int, seconds int) []int {
+	counts := make([]int, seconds)
+	for index := range counts {
+		counts[index] = count
+	}
+	return counts
+}
+
+// check compares the recorded alerts with those wanted, comparing only the named fields.
+func (r *alertRecorder) check(t *testing.T, fields []string, want []Alert, options ...cmp.Option) {
+	t.Helper()
+	compared := make(map[string]bool)
+	for _, field := range fields {
+		compared[field] = true
+	}
+	ignored := cmp.FilterPath(func(path cmp.Path) bool {
+		field, ok := path.Last().(cmp.StructField)
+		return ok && path.Index(-2).Type() == reflect.TypeOf(Alert{}) && !compared[field.Name()]
+	}, cmp.Ignore())
+	options = append(options, cmp.AllowUnexported(Alert{}), ignored)
+	if diff := cmp.Diff(want, r.alerts, options...); diff != "" {
+		t.Errorf("Monitor sent alerts which differ (-want +got):\n%s", diff)
+	}
+}
+
 func TestMonitor(t *testing.T) {
 	currTime := time.Now().Unix()
 	monitor := NewMonitor(1, 3)
@@ -14,21 +79,15 @@ func TestMonitor(t *testing.T) {
 		hits      int
 		alertTime int64
 	}{
-		{AlertTraffic, 3, currTime + 1},
+		{AlertFiring, 3, currTime + 1},
 		{AlertNone, 1, currTime + 4},
 	}
 
-	// Save and restore original sendAlert
-	savedSendAlert := sendAlert
-	defer func() {
-		sendAlert = savedSendAlert
-	}()
-
-	// Install the test's sendAlert
 	index := 0
-	sendAlert = func(alert AlertState, hits int, alertTime int64) {
+	onAlert := func(a Alert) {
+		alert, hits, alertTime := a.state, int(a.value), a.time
 		if index >= len(wants) {
-			t.Errorf(`Alert unexpected: sendAlert(%v, %v, %v)`, alert, hits, alertTime)
+			t.Errorf(`Alert unexpected: (alert=%v, hits=%v, time=%v)`, alert, hits, alertTime)
 			return
 		}
 		want := wants[index]
@@ -38,17 +97,408 @@ func TestMonitor(t *testing.T) {
 		}
 		index++
 	}
+	monitor.sink = funcSink{alert: onAlert}
+
+	monitor.Hit(LogModel{})
+	monitor.Hit(LogModel{})
+	monitor.Hit(LogModel{})
+	currTime++
+	monitor.Tick(currTime)
+	monitor.Hit(LogModel{})
+	currTime++
+	monitor.Tick(currTime)
+	currTime++
+	monitor.Tick(currTime)
+	currTime++
+	monitor.Tick(currTime)
+}
+
+func TestMonitorRules(t *testing.T) {
+	currTime := time.Now().Unix()
+	monitor, err := NewRuleMonitor([]Rule{
+		{Name: "host_errors", Metric: MetricHits, Filter: map[string]string{"status": "5xx"}, GroupBy: "remotehost",
+			Window: 2, Op: ">=", Threshold: 2, Severity: SeverityCritical},
+		{Name: "bandwidth", Metric: MetricBytes, Window: 2, Op: ">", Threshold: 100, PerSecond: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type alertKey struct {
+		rule  string
+		key   string
+		state AlertState
+		time  int64
+	}
+	var got []alertKey
+	onAlert := func(a Alert) {
+		got = append(got, alertKey{a.rule, a.key, a.state, a.time})
+	}
+	monitor.sink = funcSink{alert: onAlert}
 
-	monitor.Hit()
-	monitor.Hit()
-	monitor.Hit()
+	monitor.Hit(LogModel{remoteHost: "10.0.0.1", status: 500, bytes: 150})
+	monitor.Hit(LogModel{remoteHost: "10.0.0.1", status: 503, bytes: 100})
+	monitor.Hit(LogModel{remoteHost: "10.0.0.2", status: 500})
+	monitor.Hit(LogModel{remoteHost: "10.0.0.2", status: 200})
 	currTime++
 	monitor.Tick(currTime)
-	monitor.Hit()
 	currTime++
 	monitor.Tick(currTime)
 	currTime++
 	monitor.Tick(currTime)
+
+	want := []alertKey{
+		{"host_errors", "10.0.0.1", AlertFiring, currTime - 2},
+		{"bandwidth", "", AlertFiring, currTime - 2},
+		{"host_errors", "10.0.0.1", AlertNone, currTime},
+		{"bandwidth", "", AlertNone, currTime},
+	}
+	if !cmp.Equal(got, want, cmp.AllowUnexported(alertKey{})) {
+		t.Errorf(`Monitor sent alerts %v, want %v`, got, want)
+	}
+}
+
+func TestMonitorDuplicateRule(t *testing.T) {
+	rule := HighTrafficRule(10, 120)
+	if _, err := NewRuleMonitor([]Rule{rule, rule}); err == nil {
+		t.Errorf(`NewRuleMonitor with a duplicate rule returned no error`)
+	}
+}
+
+func TestMonitorFresh(t *testing.T) {
+	monitor := NewMonitor(1, 2)
+	monitor.Sync(0)
+	monitor.Hit(LogModel{date: 0, section: "/api"})
+
+	// A fresh monitor evaluates the same rules with no window history.
+	fresh := monitor.fresh()
+	if len(fresh.rules) != 1 || fresh.rules[0].rule.Name != monitor.rules[0].rule.Name {
+		t.Fatalf(`fresh monitor has rules %v, want the high traffic rule`, fresh.rules)
+	}
+	if w := fresh.rules[0].groups[""]; w == nil || w.current.value != 0 {
+		t.Errorf(`fresh monitor window is %+v, want an empty window`, w)
+	}
+}
+
+func TestMonitorSetRules(t *testing.T) {
+	currTime := time.Now().Unix()
+	rule := Rule{Name: "hits", Metric: MetricHits, Window: 3, Op: ">=", Threshold: 3}
+	monitor, err := NewRuleMonitor([]Rule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []AlertState
+	var gotTimes []int64
+	onAlert := func(a Alert) {
+		got = append(got, a.state)
+		gotTimes = append(gotTimes, a.time)
+	}
+	monitor.sink = funcSink{alert: onAlert}
+
+	monitor.Hit(LogModel{})
+	monitor.Hit(LogModel{})
+	currTime++
+	monitor.Tick(currTime)
+
+	// Lowering the threshold keeps the two hits already in the window.
+	rule.Threshold = 2
+	if err := monitor.SetRules([]Rule{rule}); err != nil {
+		t.Fatal(err)
+	}
+	currTime++
+	monitor.Tick(currTime)
+
+	// Shrinking the window discards the second with the hits.
+	rule.Window = 1
+	if err := monitor.SetRules([]Rule{rule}); err != nil {
+		t.Fatal(err)
+	}
 	currTime++
 	monitor.Tick(currTime)
+
+	// An invalid rule leaves the rules unchanged.
+	if err := monitor.SetRules([]Rule{rule, {Name: "invalid"}}); err == nil {
+		t.Errorf(`SetRules with an invalid rule returned no error`)
+	}
+	if len(monitor.rules) != 1 || monitor.rules[0].rule.Window != 1 {
+		t.Errorf(`SetRules with an invalid rule changed the rules`)
+	}
+
+	want := []AlertState{AlertFiring, AlertNone}
+	wantTimes := []int64{currTime - 1, currTime}
+	if !cmp.Equal(got, want) || !cmp.Equal(gotTimes, wantTimes) {
+		t.Errorf(`Monitor sent alerts %v at %v, want %v at %v`, got, gotTimes, want, wantTimes)
+	}
+}
+
+func TestMonitorErrorRate(t *testing.T) {
+	currTime := time.Now().Unix()
+	monitor, err := NewRuleMonitor([]Rule{
+		ErrorRateRule("server_errors", "Server error rate", "5xx", 20, 10, 2),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type alertKey struct {
+		state AlertState
+		value float64
+		time  int64
+	}
+	var got []alertKey
+	onAlert := func(a Alert) {
+		got = append(got, alertKey{a.state, a.value, a.time})
+	}
+	monitor.sink = funcSink{alert: onAlert}
+
+	hits := func(ok int, errors int) {
+		for i := 0; i < ok; i++ {
+			monitor.Hit(LogModel{status: 200})
+		}
+		for i := 0; i < errors; i++ {
+			monitor.Hit(LogModel{status: 503})
+		}
+		currTime++
+		monitor.Tick(currTime)
+	}
+
+	// Too few requests to alert, despite every request failing.
+	hits(0, 5)
+	// 10 requests over the window, of which 6 failed.
+	hits(4, 1)
+	// The first second has left the window, so 1 of 20 requests failed.
+	hits(15, 0)
+	// 1 of 40 requests failed.
+	hits(24, 1)
+
+	want := []alertKey{
+		{AlertFiring, 60, currTime - 2},
+		{AlertNone, 5, currTime - 1},
+	}
+	if !cmp.Equal(got, want, cmp.AllowUnexported(alertKey{})) {
+		t.Errorf(`Monitor sent alerts %v, want %v`, got, want)
+	}
+}
+
+func TestMonitorLatency(t *testing.T) {
+	monitor, err := NewRuleMonitor([]Rule{HighLatencyRule(90, 1, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := recordAlerts(monitor, time.Now().Unix())
+
+	second := func(fast int, slow int) {
+		var lines []LogModel
+		for i := 0; i < fast; i++ {
+			lines = append(lines, LogModel{latency: 0.1, timed: true})
+		}
+		for i := 0; i < slow; i++ {
+			lines = append(lines, LogModel{latency: 3, timed: true})
+		}
+		// Lines without a request time are not counted.
+		r.tick(append(lines, LogModel{})...)
+	}
+
+	start := r.time
+	// 1 of 10 requests is slow, so the 90th percentile is fast.
+	second(9, 1)
+	// 3 of 20 requests over the window are slow.
+	second(8, 2)
+	// The first second has left the window, so 2 of 28 requests are slow.
+	second(18, 0)
+	// 0 of 18 requests are slow.
+	second(0, 0)
+
+	r.check(t, []string{"state", "time"}, []Alert{
+		{state: AlertFiring, time: start + 2},
+		{state: AlertNone, time: start + 3},
+	})
+	if len(r.alerts) != 2 || math.Abs(r.alerts[0].value-3) > sketchAccuracy*3 {
+		t.Errorf(`Monitor sent alerts %v, want a latency of 3s when firing`, r.alerts)
+	}
+}
+
+func TestMonitorBaseline(t *testing.T) {
+	rule := TrafficAnomalyRule(3, BaselineEWMA, 1)
+	rule.HalfLife = 10
+	monitor, err := NewRuleMonitor([]Rule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := recordAlerts(monitor, time.Now().Unix())
+
+	// The baseline is not used until it has learned for its half-life.
+	r.hits(LogModel{}, repeat(10, 11)...)
+	// A spike is more than 3 standard deviations, at least the square root of the mean, above.
+	r.hits(LogModel{}, 50)
+	spike := r.time
+	r.hits(LogModel{}, 10, 10)
+	// A drop is more than 3 standard deviations below.
+	r.hits(LogModel{}, 0)
+	drop := r.time
+	r.hits(LogModel{}, 10)
+
+	approx := cmp.Comparer(func(a, b float64) bool {
+		return math.Abs(a-b) < 0.5
+	})
+	r.check(t, []string{"state", "value", "expected", "time"}, []Alert{
+		{state: AlertFiring, value: 50, expected: 10, time: spike},
+		{state: AlertNone, value: 10, expected: 10, time: spike + 1},
+		{state: AlertFiring, value: 0, expected: 10, time: drop},
+		{state: AlertNone, value: 10, expected: 10, time: drop + 1},
+	}, approx)
+}
+
+func TestMonitorLowTraffic(t *testing.T) {
+	currTime := time.Now().Unix()
+	grouped := LowTrafficRule(1, 3)
+	grouped.Name = "section_low_traffic"
+	grouped.GroupBy = "section"
+	monitor, err := NewRuleMonitor([]Rule{LowTrafficRule(1, 3), grouped})
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitor.Sync(currTime)
+	r := recordAlerts(monitor, currTime)
+
+	// No lines arrive, so low traffic fires once the warm-up of a window has passed.
+	r.hits(LogModel{}, 0, 0, 0)
+	// A new section is not compared until its window is full.
+	r.hits(LogModel{section: "/api"}, 2)
+	start := r.time
+	r.hits(LogModel{}, 0, 0, 0)
+	// Traffic returns to the floor of 3 hits over the window.
+	r.hits(LogModel{section: "/api"}, 3)
+
+	r.check(t, []string{"rule", "key", "state", "time"}, []Alert{
+		{rule: "low_traffic", state: AlertFiring, time: start - 1},
+		{rule: "section_low_traffic", key: "/api", state: AlertFiring, time: start + 2},
+		{rule: "low_traffic", state: AlertNone, time: start + 4},
+		{rule: "section_low_traffic", key: "/api", state: AlertNone, time: start + 4},
+	})
+}
+
+func TestMonitorHysteresis(t *testing.T) {
+	rule := Rule{Name: "traffic", Metric: MetricHits, Window: 1, Op: ">=", Threshold: 10, Recover: 5, For: 1, RecoverFor: 1}
+	monitor, err := NewRuleMonitor([]Rule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := recordAlerts(monitor, time.Now().Unix())
+
+	start := r.time
+	// A single second above the threshold is not enough to fire.
+	r.hits(LogModel{}, 12, 8)
+	// Once firing, hovering between the recover threshold and the threshold does not recover.
+	r.hits(LogModel{}, 12, 11, 8, 6, 9)
+	// A single second below the recover threshold is not enough to recover.
+	r.hits(LogModel{}, 4, 6, 3, 2)
+
+	r.check(t, []string{"state", "time"}, []Alert{
+		{state: AlertFiring, time: start + 4},
+		{state: AlertNone, time: start + 11},
+	})
+}
+
+func TestMonitorFlapping(t *testing.T) {
+	rule := Rule{Name: "traffic", Metric: MetricHits, Window: 1, Op: ">=", Threshold: 10, FlapLimit: 2, FlapWindow: 5}
+	monitor, err := NewRuleMonitor([]Rule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := recordAlerts(monitor, time.Now().Unix())
+
+	start := r.time
+	// The third change within 5 seconds is suppressed, as are those after it.
+	r.hits(LogModel{}, 10, 0, 10, 0, 10)
+	// The alert settles once there are no more than 2 changes within 5 seconds.
+	r.hits(LogModel{}, 10, 10, 10, 10, 10)
+
+	r.check(t, []string{"state", "time"}, []Alert{
+		{state: AlertFiring, time: start + 1},
+		{state: AlertNone, time: start + 2},
+		{state: AlertFlapping, time: start + 3},
+		{state: AlertFiring, time: start + 8},
+	})
+}
+
+func TestMonitorSeverity(t *testing.T) {
+	rule := Rule{Name: "traffic", Metric: MetricHits, Window: 1, Op: ">=", Threshold: 10, Critical: 25}
+	monitor, err := NewRuleMonitor([]Rule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := recordAlerts(monitor, time.Now().Unix())
+
+	start := r.time
+	// Each change between levels is reported, including straight from critical to recovered.
+	r.hits(LogModel{}, 5, 12, 30, 28, 12, 3, 30, 3)
+
+	r.check(t, []string{"state", "severity", "escalated", "time"}, []Alert{
+		{state: AlertFiring, severity: SeverityWarning, time: start + 2},
+		{state: AlertFiring, severity: SeverityCritical, escalated: true, time: start + 3},
+		{state: AlertFiring, severity: SeverityWarning, escalated: true, time: start + 5},
+		{state: AlertNone, severity: SeverityWarning, time: start + 6},
+		{state: AlertFiring, severity: SeverityCritical, time: start + 7},
+		{state: AlertNone, severity: SeverityCritical, time: start + 8},
+	})
+}
+
+func TestMonitorGroups(t *testing.T) {
+	currTime := time.Now().Unix()
+	rule := SectionTrafficRule(1, "section", 2)
+	rule.MaxGroups = 2
+	monitor, err := NewRuleMonitor([]Rule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type alertKey struct {
+		key   string
+		state AlertState
+		time  int64
+	}
+	var got []alertKey
+	onAlert := func(a Alert) {
+		got = append(got, alertKey{a.key, a.state, a.time})
+	}
+	monitor.sink = funcSink{alert: onAlert}
+
+	// Each section alerts independently, and /report is not monitored while two sections are.
+	for i := 0; i < 2; i++ {
+		monitor.Hit(LogModel{section: "/api"})
+	}
+	monitor.Hit(LogModel{section: "/help"})
+	monitor.Hit(LogModel{section: "/report"})
+	monitor.Hit(LogModel{section: "/report"})
+	currTime++
+	monitor.Tick(currTime)
+	if len(monitor.rules[0].groups) != 2 {
+		t.Errorf(`Monitor kept %v groups, want 2`, len(monitor.rules[0].groups))
+	}
+
+	// Idle sections are evicted once the window has passed and they have recovered.
+	for i := 0; i < 3; i++ {
+		currTime++
+		monitor.Tick(currTime)
+	}
+	if len(monitor.rules[0].groups) != 0 {
+		t.Errorf(`Monitor kept %v idle groups, want 0`, len(monitor.rules[0].groups))
+	}
+
+	// Once evicted, new sections are monitored.
+	monitor.Hit(LogModel{section: "/report"})
+	monitor.Hit(LogModel{section: "/report"})
+	currTime++
+	monitor.Tick(currTime)
+
+	want := []alertKey{
+		{"/api", AlertFiring, currTime - 4},
+		{"/api", AlertNone, currTime - 2},
+		{"/report", AlertFiring, currTime},
+	}
+	if !cmp.Equal(got, want, cmp.AllowUnexported(alertKey{})) {
+		t.Errorf(`Monitor sent alerts %v, want %v`, got, want)
+	}
 }
@@ -0,0 +1,468 @@
+/*
+A `Parser` converts a single line of a HTTP access log into a `LogModel`. The following formats
+are supported:
+
+	csv:      a header line naming the columns, followed by one csv-encoded request per line. A
+	          quoted field may contain newlines, continuing the request onto the next lines.
+	clf:      the Common Log Format written by Apache and Nginx.
+	combined: the Combined Log Format, which extends clf with the referer and user-agent.
+	json:     one JSON object per line, with a configurable mapping of keys to fields.
+
+Each format may also carry the time taken to serve the request in seconds, as written by Nginx's
+$request_time: in a request_time csv column, after the bytes or user-agent of a clf or combined
+line, or in a request_time JSON key. Lines without it are still counted, but not in latencies.
+*/
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatCSV      = "csv"
+	FormatCLF      = "clf"
+	FormatCombined = "combined"
+	FormatJSON     = "json"
+
+	clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+)
+
+// errSkipLine is returned by a Parser for lines, such as headers, which are not access requests.
+var errSkipLine = errors.New("line is not an access request")
+
+type Parser interface {
+	Parse(line string) (LogModel, error)
+}
+
+// HeaderParser is implemented by a Parser, such as csv, whose inputs start with a header line.
+type HeaderParser interface {
+	Header()
+}
+
+// MultilineParser is implemented by a Parser, such as csv, whose records may continue onto the
+// next line.
+type MultilineParser interface {
+	Continues(record string) bool
+}
+
+// ParserFactory returns a new Parser for each input, so that state such as the csv header
+// is not shared between files.
+type ParserFactory func() Parser
+
+// NewParserFactory returns a ParserFactory for the given log format and JSON field mapping.
+func NewParserFactory(format string, fields map[string]string) (ParserFactory, error) {
+	if _, err := NewParser(format, fields); err != nil {
+		return nil, err
+	}
+	return func() Parser {
+		parser, _ := NewParser(format, fields)
+		return parser
+	}, nil
+}
+
+// NewParser returns a new Parser for the given log format. The fields map JSON keys to
+// LogModel fields and are only used by the json format.
+func NewParser(format string, fields map[string]string) (Parser, error) {
+	switch format {
+	case FormatCSV:
+		return NewCSVParser(), nil
+	case FormatCLF:
+		return NewCLFParser(false), nil
+	case FormatCombined:
+		return NewCLFParser(true), nil
+	case FormatJSON:
+		return NewJSONParser(fields)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+type CSVParser struct {
+	header []string       // the header line of the csv
+	logMap map[string]int // maps a request header to the index within a log line
+}
+
+// NewCSVParser returns a new instance of the CSVParser.
+func NewCSVParser() *CSVParser {
+	return &CSVParser{
+		logMap: make(map[string]int),
+	}
+}
+
+// Parse parses a csv line. The first line is taken to be the header, as is any later line
+// identical to it, such as the header at the start of a rotated file.
+func (p *CSVParser) Parse(line string) (LogModel, error) {
+	fields, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil {
+		return LogModel{}, err
+	}
+	if p.header == nil {
+		if err := p.parseHeader(fields); err != nil {
+			return LogModel{}, err
+		}
+		return LogModel{}, errSkipLine
+	}
+	if equalRecords(p.header, fields) {
+		return LogModel{}, errSkipLine
+	}
+	return p.parseLog(fields)
+}
+
+// Header marks the first line of a csv input as its header.
+func (p *CSVParser) Header() {}
+
+// Continues reports whether a csv record has an open quoted field, so continues onto the next
+// line. Quotes are escaped by doubling them, so a field is open if the count of quotes is odd.
+func (p *CSVParser) Continues(record string) bool {
+	return strings.Count(record, `"`)%2 == 1
+}
+
+// parseheader takes the csv header and fills in the logMap which associates a header
+// string with an index. The date and request columns are required.
+func (p *CSVParser) parseHeader(header []string) error {
+	logMap := make(map[string]int)
+	for index, entry := range header {
+		logMap[entry] = index
+	}
+	for _, required := range []string{"date", "request"} {
+		if _, found := logMap[required]; !found {
+			return fmt.Errorf("csv header is missing the %q column", required)
+		}
+	}
+	p.header = header
+	p.logMap = logMap
+	return nil
+}
+
+// parseLog parses a line of the log file and returns a LogModel struct.
+func (p *CSVParser) parseLog(fields []string) (LogModel, error) {
+	if len(fields) != len(p.header) {
+		return LogModel{}, fmt.Errorf("line has %v fields, want %v", len(fields), len(p.header))
+	}
+	field := func(name string) string {
+		if index, found := p.logMap[name]; found {
+			return fields[index]
+		}
+		return ""
+	}
+
+	var err error
+	log := LogModel{}
+	log.remoteHost = field("remotehost")
+	log.authServer = field("rfc931")
+	log.authUser = field("authuser")
+	if log.date, err = strconv.ParseInt(field("date"), 10, 64); err != nil {
+		return LogModel{}, fmt.Errorf("invalid date %q", field("date"))
+	}
+	if log.status, err = parseCount(field("status")); err != nil {
+		return LogModel{}, fmt.Errorf("invalid status %q", field("status"))
+	}
+	if log.bytes, err = parseCount(field("bytes")); err != nil {
+		return LogModel{}, fmt.Errorf("invalid bytes %q", field("bytes"))
+	}
+	if log.latency, log.timed, err = parseLatency(field("request_time")); err != nil {
+		return LogModel{}, fmt.Errorf("invalid request_time %q", field("request_time"))
+	}
+	log.request = field("request")
+	requestData := parseRequest(log.request)
+	log.method = requestData.method
+	log.endpoint = requestData.endpoint
+	log.section = requestData.section
+	log.protocol = requestData.protocol
+	return log, nil
+}
+
+// parseCount parses a numeric log field. Access logs use "-", or an empty field, for no value
+// which is parsed as zero.
+func parseCount(field string) (int, error) {
+	if len(field) == 0 || field == "-" {
+		return 0, nil
+	}
+	return strconv.Atoi(field)
+}
+
+// parseLatency parses a request time in seconds, and reports whether the field has a value.
+func parseLatency(field string) (float64, bool, error) {
+	if len(field) == 0 || field == "-" {
+		return 0, false, nil
+	}
+	latency, err := strconv.ParseFloat(field, 64)
+	if err != nil || latency < 0 || math.IsInf(latency, 0) || math.IsNaN(latency) {
+		return 0, false, fmt.Errorf("not a number of seconds")
+	}
+	return latency, true, nil
+}
+
+// equalRecords reports whether two csv records contain the same fields.
+func equalRecords(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// clfPattern matches the Common Log Format, with the optional referer and user-agent of the
+// Combined Log Format and an optional request time:
+//
+//	host ident authuser [date] "request" status bytes "referer" "user-agent" request-time
+var clfPattern = regexp.MustCompile(
+	`^(\S+) (\S+) (\S+) \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}|-) (\d+|-)(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?(?: (\d+(?:\.\d+)?)(?:\s|$))?`)
+
+type CLFParser struct {
+	combined bool // require the referer and user-agent fields
+}
+
+// NewCLFParser returns a new instance of the CLFParser. If combined is true then lines
+// must be in the Combined Log Format.
+func NewCLFParser(combined bool) *CLFParser {
+	return &CLFParser{combined: combined}
+}
+
+// Parse parses a Common or Combined Log Format line.
+func (p *CLFParser) Parse(line string) (LogModel, error) {
+	index := clfPattern.FindStringSubmatchIndex(line)
+	if index == nil {
+		return LogModel{}, fmt.Errorf("line does not match log format: %q", line)
+	}
+	if p.combined && index[2*9] == -1 {
+		return LogModel{}, fmt.Errorf("line is missing referer and user-agent: %q", line)
+	}
+	match := make([]string, len(index)/2)
+	for i := range match {
+		if index[2*i] >= 0 {
+			match[i] = line[index[2*i]:index[2*i+1]]
+		}
+	}
+
+	date, err := time.Parse(clfTimeLayout, match[4])
+	if err != nil {
+		return LogModel{}, err
+	}
+
+	log := LogModel{}
+	log.remoteHost = match[1]
+	log.authServer = match[2]
+	log.authUser = match[3]
+	log.date = date.Unix()
+	log.request = match[5]
+	log.status, _ = parseCount(match[6])
+	log.bytes, _ = parseCount(match[7])
+	log.referer = match[8]
+	log.userAgent = match[9]
+	log.latency, log.timed, _ = parseLatency(match[10])
+	requestData := parseRequest(log.request)
+	log.method = requestData.method
+	log.endpoint = requestData.endpoint
+	log.section = requestData.section
+	log.protocol = requestData.protocol
+	return log, nil
+}
+
+// jsonFields are the LogModel fields which can be populated from a JSON log line. By default
+// each is read from the JSON key of the same name.
+var jsonFields = []string{
+	"remotehost", "rfc931", "authuser", "date", "request", "status", "bytes",
+	"method", "endpoint", "protocol", "referer", "useragent", "request_time",
+}
+
+type JSONParser struct {
+	fieldMap map[string]string // maps a JSON key to a LogModel field
+}
+
+// NewJSONParser returns a new instance of the JSONParser. The fields map JSON keys to LogModel
+// fields, overriding the default of reading each field from the key of the same name.
+func NewJSONParser(fields map[string]string) (*JSONParser, error) {
+	fieldMap := make(map[string]string)
+	for _, field := range jsonFields {
+		fieldMap[field] = field
+	}
+	for key, field := range fields {
+		if !isJSONField(field) {
+			return nil, fmt.Errorf("unknown field %q for JSON key %q, want one of %s", field, key, strings.Join(jsonFields, ", "))
+		}
+		// Stop reading the field from its default key.
+		if fieldMap[field] == field {
+			delete(fieldMap, field)
+		}
+		fieldMap[key] = field
+	}
+	return &JSONParser{fieldMap: fieldMap}, nil
+}
+
+// ParseFieldMapping parses a comma separated list of key=field pairs, such as
+// "ts=date,path=endpoint", into a map of JSON keys to LogModel fields.
+func ParseFieldMapping(mapping string) (map[string]string, error) {
+	fields := make(map[string]string)
+	if len(mapping) == 0 {
+		return fields, nil
+	}
+	for _, pair := range strings.Split(mapping, ",") {
+		split := strings.SplitN(pair, "=", 2)
+		if len(split) != 2 || len(split[0]) == 0 || len(split[1]) == 0 {
+			return nil, fmt.Errorf("invalid field mapping %q, want key=field", pair)
+		}
+		if !isJSONField(split[1]) {
+			return nil, fmt.Errorf("unknown field %q, want one of %s", split[1], strings.Join(jsonFields, ", "))
+		}
+		fields[split[0]] = split[1]
+	}
+	return fields, nil
+}
+
+// isJSONField reports whether the field can be populated from a JSON log line.
+func isJSONField(field string) bool {
+	for _, f := range jsonFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse parses a JSON object. The date may be an RFC3339 string, or a number of seconds or
+// milliseconds since the epoch.
+func (p *JSONParser) Parse(line string) (LogModel, error) {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	var object map[string]interface{}
+	if err := dec.Decode(&object); err != nil {
+		return LogModel{}, err
+	}
+
+	// Apply keys in a fixed order so that the result does not depend on map iteration.
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	log := LogModel{}
+	hasDate := false
+	for _, key := range keys {
+		field, found := p.fieldMap[key]
+		if !found || object[key] == nil {
+			continue
+		}
+		value := object[key]
+		var err error
+		switch field {
+		case "date":
+			log.date, err = parseTimestamp(value)
+			hasDate = true
+		case "status":
+			log.status, err = parseJSONInt(value)
+		case "bytes":
+			log.bytes, err = parseJSONInt(value)
+		case "request_time":
+			log.latency, log.timed, err = parseLatency(fmt.Sprint(value))
+		default:
+			err = setStringField(&log, field, fmt.Sprint(value))
+		}
+		if err != nil {
+			return LogModel{}, fmt.Errorf("invalid %s %q: %v", key, value, err)
+		}
+	}
+	if !hasDate {
+		return LogModel{}, fmt.Errorf("line has no date: %q", line)
+	}
+
+	// Fill in whichever of the request and its components are missing.
+	if len(log.request) > 0 {
+		requestData := parseRequest(log.request)
+		if len(log.method) == 0 {
+			log.method = requestData.method
+		}
+		if len(log.endpoint) == 0 {
+			log.endpoint = requestData.endpoint
+		}
+		if len(log.protocol) == 0 {
+			log.protocol = requestData.protocol
+		}
+	} else if len(log.method) > 0 && len(log.endpoint) > 0 {
+		log.request = strings.TrimSpace(log.method + " " + log.endpoint + " " + log.protocol)
+	}
+	log.section = getSection(log.endpoint)
+	return log, nil
+}
+
+// setStringField sets a string field of the LogModel by name.
+func setStringField(log *LogModel, field string, value string) error {
+	switch field {
+	case "remotehost":
+		log.remoteHost = value
+	case "rfc931":
+		log.authServer = value
+	case "authuser":
+		log.authUser = value
+	case "request":
+		log.request = value
+	case "method":
+		log.method = value
+	case "endpoint":
+		log.endpoint = value
+	case "protocol":
+		log.protocol = value
+	case "referer":
+		log.referer = value
+	case "useragent":
+		log.userAgent = value
+	default:
+		return fmt.Errorf("unknown field %q", field)
+	}
+	return nil
+}
+
+// parseTimestamp parses an RFC3339 timestamp, or a number of seconds or milliseconds since
+// the epoch, and returns the number of seconds since the epoch. Numbers greater than
+// 100,000,000,000 are taken to be milliseconds, which in seconds would be after the year 5000.
+func parseTimestamp(value interface{}) (int64, error) {
+	var number string
+	switch v := value.(type) {
+	case json.Number:
+		number = v.String()
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t.Unix(), nil
+		}
+		number = v
+	default:
+		return 0, fmt.Errorf("unsupported timestamp type %T", value)
+	}
+
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("timestamp is neither RFC3339 nor a number")
+	}
+	if f >= 1e11 {
+		f /= 1000
+	}
+	return int64(f), nil
+}
+
+// parseJSONInt parses a JSON number or numeric string. A "-" string, used by access logs
+// for no value, is parsed as zero.
+func parseJSONInt(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case json.Number:
+		i, err := v.Int64()
+		return int(i), err
+	case string:
+		return parseCount(v)
+	default:
+		return 0, fmt.Errorf("unsupported number type %T", value)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseHeader(t *testing.T) {
+	var tests = []struct {
+		input []string
+		want  map[string]int
+	}{
+		{[]string{"remotehost", "rfc931", "authuser", "date", "request", "status", "bytes"},
+			map[string]int{"remotehost": 0, "rfc931": 1, "authuser": 2, "date": 3, "request": 4, "status": 5, "bytes": 6}},
+		{[]string{"request", "authuser", "remotehost", "status", "bytes", "date", "rfc931"},
+			map[string]int{"remotehost": 2, "rfc931": 6, "authuser": 1, "date": 5, "request": 0, "status": 3, "bytes": 4}},
+	}
+
+	for _, test := range tests {
+		p := NewCSVParser()
+		if err := p.parseHeader(test.input); err != nil {
+			t.Errorf(`parser.parseHeader(%q) returned error %v`, test.input, err)
+		}
+		if !cmp.Equal(p.logMap, test.want) {
+			t.Errorf(`parser.parseHeader(%q) set logMap to %q, want %q`, test.input, p.logMap, test.want)
+		}
+	}
+}
+
+func TestParseLog(t *testing.T) {
+	var tests = []struct {
+		header []string
+		log    []string
+		want   LogModel
+	}{
+		{[]string{"remotehost", "rfc931", "authuser", "date", "request", "status", "bytes"},
+			[]string{"10.0.0.2", "-", "apache", "1549573860", "GET /api/user HTTP/1.0", "200", "1234"},
+			LogModel{"10.0.0.2", "-", "apache", 1549573860, 200, 1234, "GET /api/user HTTP/1.0", "GET", "/api/user", "/api", "HTTP/1.0", "", "", "", 0, false, false}},
+		{[]string{"bytes", "remotehost", "authuser", "rfc931", "status", "request", "date"},
+			[]string{"1194", "10.0.0.5", "apache", "-", "500", "POST /report HTTP/1.0", "1549574134"},
+			LogModel{"10.0.0.5", "-", "apache", 1549574134, 500, 1194, "POST /report HTTP/1.0", "POST", "/report", "/report", "HTTP/1.0", "", "", "", 0, false, false}},
+		{[]string{"date", "request", "request_time"},
+			[]string{"1549573860", "GET /api/user HTTP/1.0", "0.125"},
+			LogModel{"", "", "", 1549573860, 0, 0, "GET /api/user HTTP/1.0", "GET", "/api/user", "/api", "HTTP/1.0", "", "", "", 0.125, true, false}},
+		{[]string{"date", "request", "request_time"},
+			[]string{"1549573860", "GET /api/user HTTP/1.0", "-"},
+			LogModel{"", "", "", 1549573860, 0, 0, "GET /api/user HTTP/1.0", "GET", "/api/user", "/api", "HTTP/1.0", "", "", "", 0, false, false}},
+	}
+
+	for _, test := range tests {
+		p := NewCSVParser()
+		p.parseHeader(test.header)
+		if got, err := p.parseLog(test.log); err != nil || got != test.want {
+			t.Errorf(`parseLog(%s) returned %v, %v, want %v`, test.log, got, err, test.want)
+		}
+	}
+}
+
+func TestCSVParserHeaders(t *testing.T) {
+	p := NewCSVParser()
+	header := `"remotehost","rfc931","authuser","date","request","status","bytes"`
+	line := `"10.0.0.2","-","apache",1549573860,"GET /api/user HTTP/1.0",200,1234`
+
+	if _, err := p.Parse(header); err != errSkipLine {
+		t.Errorf(`Parse(header) returned error %v, want %v`, err, errSkipLine)
+	}
+	if got, err := p.Parse(line); err != nil || got.date != 1549573860 || got.section != "/api" {
+		t.Errorf(`Parse(%q) returned %v, %v`, line, got, err)
+	}
+	// A repeated header, such as after log rotation, is skipped.
+	if _, err := p.Parse(header); err != errSkipLine {
+		t.Errorf(`Parse(repeated header) returned error %v, want %v`, err, errSkipLine)
+	}
+}
+
+func TestCSVParserErrors(t *testing.T) {
+	header := `"remotehost","rfc931","authuser","date","request","status","bytes"`
+	var tests = []struct {
+		header string
+		line   string
+	}{
+		{`"remotehost","authuser","request"`, ""},
+		{header, `"10.0.0.2","-","apache",1549573860`},
+		{header, `"10.0.0.2","-","apache",1549573860,"GET /api/user HTTP/1.0",200,1234,"extra"`},
+		{header, `"10.0.0.2","-","apache",yesterday,"GET /api/user HTTP/1.0",200,1234`},
+		{header, `"10.0.0.2","-","apache",1549573860,"GET /api/user HTTP/1.0",OK,1234`},
+		{header, `"10.0.0.2","-","apache",1549573860,"GET /api/user HTTP/1.0",200,1.5kB`},
+		{header, `"10.0.0.2","-","apache",1549573860,"GET /api/user HTTP/1.0,200,1234`},
+		{`"date","request","request_time"`, `1549573860,"GET /api/user HTTP/1.0",-0.5`},
+	}
+	for _, test := range tests {
+		p := NewCSVParser()
+		_, headerErr := p.Parse(test.header)
+		if len(test.line) == 0 {
+			if headerErr == errSkipLine {
+				t.Errorf(`Parse(%q) accepted an invalid header`, test.header)
+			}
+			continue
+		}
+		if got, err := p.Parse(test.line); err == nil {
+			t.Errorf(`Parse(%q) returned %v, want an error`, test.line, got)
+		}
+	}
+}
+
+func TestCLFParser(t *testing.T) {
+	clf := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`
+	combined := `10.0.0.5 - - [07/Feb/2019:21:11:00 +0000] "POST /api/user HTTP/1.1" 500 - "http://example.com/" "Mozilla/5.0 \"test\""`
+
+	var tests = []struct {
+		format string
+		input  string
+		want   LogModel
+		fail   bool
+	}{
+		{FormatCLF, clf,
+			LogModel{"127.0.0.1", "-", "frank", 971211336, 200, 2326, "GET /apache_pb.gif HTTP/1.0", "GET", "/apache_pb.gif", "/apache_pb.gif", "HTTP/1.0", "", "", "", 0, false, false}, false},
+		{FormatCLF, combined,
+			LogModel{"10.0.0.5", "-", "-", 1549573860, 500, 0, "POST /api/user HTTP/1.1", "POST", "/api/user", "/api", "HTTP/1.1", "http://example.com/", `Mozilla/5.0 \"test\"`, "", 0, false, false}, false},
+		{FormatCombined, combined,
+			LogModel{"10.0.0.5", "-", "-", 1549573860, 500, 0, "POST /api/user HTTP/1.1", "POST", "/api/user", "/api", "HTTP/1.1", "http://example.com/", `Mozilla/5.0 \"test\"`, "", 0, false, false}, false},
+		{FormatCombined, combined + " 0.250",
+			LogModel{"10.0.0.5", "-", "-", 1549573860, 500, 0, "POST /api/user HTTP/1.1", "POST", "/api/user", "/api", "HTTP/1.1", "http://example.com/", `Mozilla/5.0 \"test\"`, "", 0.25, true, false}, false},
+		{FormatCLF, clf + " 2",
+			LogModel{"127.0.0.1", "-", "frank", 971211336, 200, 2326, "GET /apache_pb.gif HTTP/1.0", "GET", "/apache_pb.gif", "/apache_pb.gif", "HTTP/1.0", "", "", "", 2, true, false}, false},
+		{FormatCombined, clf, LogModel{}, true},
+		{FormatCLF, "not a log line", LogModel{}, true},
+		{FormatCLF, `127.0.0.1 - - [yesterday] "GET / HTTP/1.0" 200 1`, LogModel{}, true},
+	}
+
+	for _, test := range tests {
+		p, err := NewParser(test.format, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.Parse(test.input)
+		if test.fail {
+			if err == nil {
+				t.Errorf(`%s Parse(%q) returned no error`, test.format, test.input)
+			}
+		} else if err != nil || got != test.want {
+			t.Errorf(`%s Parse(%q) returned %v, %v, want %v`, test.format, test.input, got, err, test.want)
+		}
+	}
+}
+
+func TestNewParserUnknownFormat(t *testing.T) {
+	if _, err := NewParser("xml", nil); err == nil {
+		t.Errorf(`NewParser("xml", nil) returned no error`)
+	}
+}
+
+func TestJSONParser(t *testing.T) {
+	var tests = []struct {
+		fields map[string]string
+		input  string
+		want   LogModel
+		fail   bool
+	}{
+		{nil, `{"remotehost":"10.0.0.2","authuser":"apache","date":1549573860,"request":"GET /api/user HTTP/1.0","status":200,"bytes":1234}`,
+			LogModel{"10.0.0.2", "", "apache", 1549573860, 200, 1234, "GET /api/user HTTP/1.0", "GET", "/api/user", "/api", "HTTP/1.0", "", "", "", 0, false, false}, false},
+		{map[string]string{"ts": "date", "path": "endpoint", "verb": "method", "code": "status", "ua": "useragent"},
+			`{"ts":"2019-02-07T21:11:00Z","verb":"POST","path":"/report/daily","code":"503","ua":"curl/7.0","extra":{"a":1}}`,
+			LogModel{"", "", "", 1549573860, 503, 0, "POST /report/daily", "POST", "/report/daily", "/report", "", "", "curl/7.0", "", 0, false, false}, false},
+		{map[string]string{"ts": "date"}, `{"ts":1549573860123,"endpoint":"/api"}`,
+			LogModel{date: 1549573860, endpoint: "/api", section: "/api"}, false},
+		{map[string]string{"ts": "date"}, `{"ts":"2019-02-07T21:11:00.999+00:00","bytes":"-"}`,
+			LogModel{date: 1549573860}, false},
+		{nil, `{"date":1549573860,"request_time":0.004}`,
+			LogModel{date: 1549573860, latency: 0.004, timed: true}, false},
+		{map[string]string{"ts": "date"}, `{"date":1549573860}`, LogModel{}, true},
+		{nil, `{"date":1549573860,"request_time":"slow"}`, LogModel{}, true},
+		{nil, `{"date":"yesterday"}`, LogModel{}, true},
+		{nil, `{"date":1549573860,"status":"ok"}`, LogModel{}, true},
+		{nil, `not json`, LogModel{}, true},
+	}
+
+	for _, test := range tests {
+		p, err := NewParser(FormatJSON, test.fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.Parse(test.input)
+		if test.fail {
+			if err == nil {
+				t.Errorf(`json Parse(%q) returned no error`, test.input)
+			}
+		} else if err != nil || got != test.want {
+			t.Errorf(`json Parse(%q) returned %v, %v, want %v`, test.input, got, err, test.want)
+		}
+	}
+}
+
+func TestParseFieldMapping(t *testing.T) {
+	var tests = []struct {
+		input string
+		want  map[string]string
+		fail  bool
+	}{
+		{"", map[string]string{}, false},
+		{"ts=date,path=endpoint", map[string]string{"ts": "date", "path": "endpoint"}, false},
+		{"ts", nil, true},
+		{"ts=when", nil, true},
+		{"=date", nil, true},
+	}
+	for _, test := range tests {
+		got, err := ParseFieldMapping(test.input)
+		if test.fail {
+			if err == nil {
+				t.Errorf(`ParseFieldMapping(%q) returned no error`, test.input)
+			}
+		} else if err != nil || !cmp.Equal(got, test.want) {
+			t.Errorf(`ParseFieldMapping(%q) returned %v, %v, want %v`, test.input, got, err, test.want)
+		}
+	}
+}
@@ -5,61 +5,326 @@ is that any alerts must be accurate to within a second, therefore a second repre
 unit of time. As the log file is read, access hits for the current second are registered with
 the `Stats` and `Monitor`. When a timestamp in the log is greater than the current second the
 `Player` “ticks” time forward for each second until it is synchronised with the latest timestamp.
+
+In real-time mode time is instead driven by a `Clock`. A ticker moves time forward every second,
+so that alerts recover and stats are reported during quiet periods with no log lines. The clock
+runs a short delay behind the system time to give late log lines a chance to arrive. Log
+timestamps still determine which second a hit belongs to, but only the clock moves time forward:
+a line for a second the clock has not yet reached is held until it does. A line further ahead
+than the delay has a timestamp from a skewed clock, so is counted and not held, and the lines
+still held when playing ends are recorded rather than lost.
+
+When several sources are merged, such as the logs of each node in a cluster, stats and alerts
+are reported for all sources in aggregate and, optionally, for each source individually.
+
+Stats reports and alerts are sent to each of the `Player`'s sinks, such as the console or a
+file, each of which buffers events so that a slow output does not hold back time.
+
+A new config may be sent to a running `Player`, such as when the config file is re-read on
+SIGHUP. The alert rules and stats settings are replaced between log lines, so every monitor
+changes at once, and rules which still exist keep their window history.
 */
 package main
 
 import (
+	"container/heap"
 	"fmt"
+	"io"
 	"os"
+	"sync"
+	"time"
 )
 
 const (
-	defaultFilePath = "../input/sample_csv.txt"
+	defaultFilePath      = "../input/sample_csv.txt"
+	defaultRealtimeDelay = 2
 )
 
 type Player struct {
-	reader  *Reader
+	reader        LogSource
+	stats         *Stats
+	monitor       *Monitor
+	sinks         *Fanout                 // outputs for stats reports and alerts
+	perSource     bool                    // also report stats and alerts for each source
+	sources       map[string]*sourceState // stats and monitor for each source
+	sourceOrder   []*sourceState          // sources in the order they were first seen
+	statsInterval int64
+	clock         Clock         // drives time in real-time mode, nil when replaying a log
+	delay         int64         // seconds the real-time clock waits for late log lines
+	tick          int64         // start of the next second, the current second is tick-1
+	late          int           // lines not processed as earlier than the current second
+	early         int           // real-time lines not processed as too far ahead of the clock
+	pending       PriorityQueue // real-time lines later than the current second, earliest first
+	reloads       chan Config   // configs to apply while playing, nil if not reloadable
+	closers       []io.Closer   // files closed after the sinks, such as the rejects file
+	stop          chan struct{} // closed to stop playing before the input ends
+	stopOnce      sync.Once
+}
+
+// sourceState holds the stats and monitor for a single source.
+type sourceState struct {
 	stats   *Stats
 	monitor *Monitor
 }
 
 // NewPlayer returns a new instance of the Player.
 func NewPlayer(filePath string, statsInterval int64, monitorRps int, monitorWindow int) *Player {
-	return &Player{
-		reader:  NewReader(filePath),
-		stats:   NewStats(statsInterval),
-		monitor: NewMonitor(monitorRps, monitorWindow),
+	p := &Player{
+		reader:        NewReader(filePath),
+		stats:         NewStats(statsInterval),
+		monitor:       NewMonitor(monitorRps, monitorWindow),
+		sinks:         &Fanout{},
+		sources:       make(map[string]*sourceState),
+		statsInterval: statsInterval,
+		delay:         defaultRealtimeDelay,
+		stop:          make(chan struct{}),
+	}
+	p.stats.sink = p.sinks
+	p.monitor.sink = p.sinks
+	return p
+}
+
+// AddSink adds an output for stats reports and alerts. Events are buffered for the sink so
+// that it is written to without holding back playback.
+func (p *Player) AddSink(sink Sink) {
+	p.sinks.Add(newBufferedSink(sink, defaultSinkBuffer))
+}
+
+// Close waits for the stats reports and alerts sent to each sink to be written, and closes
+// the sinks and any other files the Player was given.
+func (p *Player) Close() error {
+	first := p.sinks.Close()
+	for _, closer := range p.closers {
+		if err := closer.Close(); err != nil && first == nil {
+			first = err
+		}
 	}
+	p.closers = nil
+	return first
+}
+
+// Stop makes Play return without waiting for the input to end, such as on SIGINT. Lines not yet
+// read are not processed, but those held for the real-time clock are.
+func (p *Player) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+// AddRule adds an alert rule to be evaluated for all sources and for each source.
+func (p *Player) AddRule(rule Rule) error {
+	return p.monitor.AddRule(rule)
+}
+
+// Reload replaces the alert rules and stats settings with those in the config. If the config
+// is invalid nothing is changed.
+func (p *Player) Reload(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	rules := config.AlertRules()
+	interval := int64(config.Stats.Interval)
+	// Check the stats settings before any monitor changes, so they cannot fall out of step.
+	if err := NewStats(interval).Configure(config.Stats); err != nil {
+		return err
+	}
+	if err := p.monitor.SetRules(rules); err != nil {
+		return err
+	}
+	p.stats.SetInterval(interval)
+	if err := p.stats.Configure(config.Stats); err != nil {
+		return err
+	}
+	for _, source := range p.sourceOrder {
+		if err := source.monitor.SetRules(rules); err != nil {
+			return err
+		}
+		source.stats.SetInterval(interval)
+		if err := source.stats.Configure(config.Stats); err != nil {
+			return err
+		}
+	}
+	p.statsInterval = interval
+	return nil
+}
+
+// reload applies a config received while playing and reports the outcome.
+func (p *Player) reload(config Config) {
+	if err := p.Reload(config); err != nil {
+		fmt.Fprintf(os.Stderr, "Config not reloaded: %v.\n", err)
+		return
+	}
+	fmt.Fprint(os.Stderr, "Config reloaded.\n")
 }
 
 // Play starts playback of a log file.
 func (p *Player) Play() {
 	src := make(chan LogModel)
-	tick := int64(0)
 
 	go p.reader.Process(src)
-	for line := range src {
-		if tick == 0 {
-			// First log line, sync monitor and stats.
-			p.monitor.Sync(line.date)
-			p.stats.Sync(line.date)
-			tick = line.date + 1
+	if p.clock != nil {
+		p.playRealtime(src)
+	} else {
+		p.playLog(src)
+	}
+	if p.late > 0 {
+		fmt.Fprintf(os.Stderr, "%v access requests not processed as earlier than the current second.\n", p.late)
+	}
+	if p.early > 0 {
+		fmt.Fprintf(os.Stderr, "%v access requests not processed as too far ahead of the clock.\n", p.early)
+	}
+}
+
+// playLog moves time forward as log lines with later timestamps are received.
+func (p *Player) playLog(src chan LogModel) {
+	for {
+		select {
+		case line, ok := <-src:
+			if !ok {
+				return
+			}
+			if line.heartbeat {
+				continue
+			}
+			if p.tick == 0 {
+				// First log line, sync monitor and stats.
+				p.sync(line.date)
+			}
+			p.hit(line)
+		case config := <-p.reloads:
+			p.reload(config)
+		case <-p.stop:
+			return
 		}
+	}
+}
 
-		// Reject access requests which occured before this second.
-		if line.date < tick-1 {
-			fmt.Fprintf(os.Stderr, "Access request not processed. Request time %v, current tick started at %v. %v", line.date, tick-1, line)
-			continue
+// playRealtime moves time forward each second according to the clock. It returns once
+// the source channel is closed, recording any lines still held.
+func (p *Player) playRealtime(src chan LogModel) {
+	ticker := p.clock.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer p.flush()
+
+	p.sync(p.clock.Now().Unix() - p.delay)
+	for {
+		select {
+		case line, ok := <-src:
+			if !ok {
+				return
+			}
+			if !line.heartbeat {
+				p.hit(line)
+			}
+		case now := <-ticker.C():
+			p.advance(now.Unix() - p.delay)
+		case config := <-p.reloads:
+			p.reload(config)
+		case <-p.stop:
+			return
 		}
+	}
+}
 
-		// Bring time forward until it is synchronised with the latest timestamp
-		for ; tick <= line.date; tick = tick + 1 {
-			p.monitor.Tick(tick)
-			p.stats.Tick(tick)
+// sync synchronises the monitor and stats with the given second.
+func (p *Player) sync(t int64) {
+	p.monitor.Sync(t)
+	p.stats.Sync(t)
+	p.tick = t + 1
+}
+
+// advance brings time forward until the given second is the current second.
+func (p *Player) advance(t int64) {
+	for ; p.tick <= t; p.tick = p.tick + 1 {
+		p.monitor.Tick(p.tick)
+		p.stats.Tick(p.tick)
+		for _, source := range p.sourceOrder {
+			source.monitor.Tick(p.tick)
+			source.stats.Tick(p.tick)
+		}
+		// Record the held lines which belong to the new current second.
+		for len(p.pending) > 0 && p.pending[0].priority <= p.tick {
+			p.record(heap.Pop(&p.pending).(*LogItem).value.(LogModel))
+		}
+	}
+}
+
+// flush records the lines held for the real-time clock, moving time forward to the latest.
+func (p *Player) flush() {
+	latest := p.tick - 1
+	for _, item := range p.pending {
+		if item.priority > latest {
+			latest = item.priority
 		}
+	}
+	p.advance(latest)
+}
+
+// source returns the stats and monitor for a source, creating them if this is the first
+// line from the source.
+func (p *Player) source(name string) *sourceState {
+	source, found := p.sources[name]
+	if !found {
+		// The rules of the monitor for all sources have been validated, so are used for each.
+		source = &sourceState{
+			stats:   NewStats(p.statsInterval),
+			monitor: p.monitor.fresh(),
+		}
+		source.stats.name = name
+		source.stats.sink = p.sinks
+		source.stats.SetDimensions(p.stats.Dimensions())
+		source.monitor.name = name
+		source.monitor.sink = p.sinks
+		source.stats.Sync(p.tick - 1)
+		source.stats.tickReport = p.stats.tickReport
+		source.monitor.Sync(p.tick - 1)
+		p.sources[name] = source
+		p.sourceOrder = append(p.sourceOrder, source)
+	}
+	return source
+}
+
+// hit registers a log line with the monitor and stats. When replaying a log, time is moved
+// forward if the line is later than the current second. In real-time mode only the clock moves
+// time forward, so such a line is held until the clock reaches its second.
+func (p *Player) hit(line LogModel) {
+	// Reject access requests which occured before this second, reporting only the first.
+	if line.date < p.tick-1 {
+		p.late++
+		if p.late == 1 {
+			fmt.Fprintf(os.Stderr, "Access request not processed, further late requests are counted. Request time %v, current tick started at %v. %v\n", line.date, p.tick-1, line)
+		}
+		return
+	}
+
+	if p.clock != nil {
+		// A line further ahead than the delay is from a skewed clock, and would be held for
+		// as long as it is ahead, so is not processed.
+		if line.date > p.tick+p.delay {
+			p.early++
+			if p.early == 1 {
+				fmt.Fprintf(os.Stderr, "Access request not processed as too far ahead of the clock, further early requests are counted. Request time %v, current tick started at %v. %v\n", line.date, p.tick-1, line)
+			}
+			return
+		}
+		if line.date >= p.tick {
+			heap.Push(&p.pending, &LogItem{value: line, priority: line.date})
+			return
+		}
+	} else {
+		// Bring time forward until it is synchronised with the latest timestamp
+		p.advance(line.date)
+	}
+	p.record(line)
+}
 
-		// Register a hit
-		p.monitor.Hit()
-		p.stats.Hit(line.section)
+// record registers a hit for a log line in the current second.
+func (p *Player) record(line LogModel) {
+	p.monitor.Hit(line)
+	p.stats.Hit(line)
+	if p.perSource {
+		source := p.source(line.source)
+		source.monitor.Hit(line)
+		source.stats.Hit(line)
 	}
 }
@@ -1,22 +1,16 @@
 package main
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestPlay(t *testing.T) {
-	// Save and restore original sendStats and sendAlert
-	savedSendStats := sendStats
-	savedSendAlert := sendAlert
-	defer func() {
-		sendStats = savedSendStats
-		sendAlert = savedSendAlert
-	}()
-
-	// Install the test's sendStats
 	statInterval := int64(10)
 	statWant := int64(1549573869)
-	sendStats = func(tick int64, topK []TopKResult) {
-		if tick != statWant {
-			t.Errorf(`Incorrect Stats update, want %v, got %v`, tick, statWant)
+	onStats := func(report StatsReport) {
+		if report.tick != statWant {
+			t.Errorf(`Incorrect Stats update, want %v, got %v`, report.tick, statWant)
 		}
 		statWant += statInterval
 	}
@@ -26,15 +20,15 @@ func TestPlay(t *testing.T) {
 		alert     AlertState
 		hits      int
 	}{
-		{1549573957, AlertTraffic, 1206},
+		{1549573957, AlertFiring, 1206},
 		{1549574044, AlertNone, 0},
-		{1549574164, AlertTraffic, 1218},
+		{1549574164, AlertFiring, 1218},
 		{1549574303, AlertNone, 0},
 	}
 
-	// Install the test's sendAlert
 	index := 0
-	sendAlert = func(alert AlertState, hits int, alertTime int64) {
+	onAlert := func(a Alert) {
+		alert, hits, alertTime := a.state, int(a.value), a.time
 		want := alertWant[index]
 		if alert != want.alert || (hits != want.hits && alert != AlertNone) || alertTime != want.timestamp {
 			t.Errorf(`Incorrect alert, want alert: %v hits: %v time: %v, got alert: %v hits: %v time: %v`,
@@ -45,5 +39,277 @@ func TestPlay(t *testing.T) {
 	}
 
 	p := NewPlayer(defaultFilePath, statInterval, 10, 120)
+	p.AddSink(funcSink{stats: onStats, alert: onAlert})
 	p.Play()
+	p.Close()
+}
+
+// fakeClock is a Clock whose ticks are sent by the test.
+type fakeClock struct {
+	now   time.Time
+	ticks chan time.Time
+}
+
+func newFakeClock(now int64) *fakeClock {
+	return &fakeClock{now: time.Unix(now, 0), ticks: make(chan time.Time)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return c
+}
+
+func (c *fakeClock) C() <-chan time.Time {
+	return c.ticks
+}
+
+func (c *fakeClock) Stop() {}
+
+// Advance moves the clock forward and delivers a tick.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.ticks <- c.now
+}
+
+func TestPlayRealtime(t *testing.T) {
+	start := int64(1549573860)
+	var tests = []struct {
+		delay          int64
+		lines          []int64 // timestamps of the lines received before the clock moves
+		wantHits       int
+		wantAlertTimes []int64
+	}{
+		// A burst of traffic in the first second, followed by silence.
+		{0, []int64{start, start, start}, 3, []int64{start + 1, start + 4}},
+		// Lines ahead of the delayed clock are held until it reaches their second, so a late
+		// line for an earlier second is still counted.
+		{2, []int64{start + 2, start + 2, start + 2, start + 1}, 4, []int64{start + 3, start + 6}},
+	}
+	for _, test := range tests {
+		var stats []int64
+		var hits int
+		onStats := func(report StatsReport) {
+			stats = append(stats, report.tick)
+			if len(stats) == 1 {
+				for _, result := range report.sections {
+					hits += result.hits
+				}
+			}
+		}
+		var alerts []AlertState
+		var alertTimes []int64
+		onAlert := func(a Alert) {
+			alerts = append(alerts, a.state)
+			alertTimes = append(alertTimes, a.time)
+		}
+
+		clock := newFakeClock(start + test.delay)
+		p := NewPlayer("", 5, 1, 3)
+		p.AddSink(funcSink{stats: onStats, alert: onAlert})
+		p.clock = clock
+		p.delay = test.delay
+
+		src := make(chan LogModel)
+		done := make(chan bool)
+		go func() {
+			p.playRealtime(src)
+			done <- true
+		}()
+
+		for _, date := range test.lines {
+			src <- LogModel{date: date, section: "/api"}
+		}
+		for i := 0; i < 10; i++ {
+			clock.Advance(time.Second)
+		}
+		close(src)
+		<-done
+		p.Close()
+
+		wantAlerts := []AlertState{AlertFiring, AlertNone}
+		if len(alerts) != len(wantAlerts) {
+			t.Fatalf(`playRealtime with delay %v sent alerts %v, want %v`, test.delay, alerts, wantAlerts)
+		}
+		for i := range alerts {
+			if alerts[i] != wantAlerts[i] || alertTimes[i] != test.wantAlertTimes[i] {
+				t.Errorf(`playRealtime with delay %v alert %v was %v at %v, want %v at %v`,
+					test.delay, i, alerts[i], alertTimes[i], wantAlerts[i], test.wantAlertTimes[i])
+			}
+		}
+
+		wantStats := []int64{start + 5, start + 10}
+		if len(stats) != len(wantStats) || stats[0] != wantStats[0] || stats[1] != wantStats[1] {
+			t.Errorf(`playRealtime with delay %v sent stats at %v, want %v`, test.delay, stats, wantStats)
+		}
+		if hits != test.wantHits {
+			t.Errorf(`playRealtime with delay %v reported %v hits, want %v`, test.delay, hits, test.wantHits)
+		}
+	}
+}
+
+func TestPlayRealtimeHeld(t *testing.T) {
+	start := int64(1549573860)
+	p := NewPlayer("", 5, 1, 3)
+	p.clock = newFakeClock(start + 2)
+	p.delay = 2
+	src := make(chan LogModel)
+	done := make(chan bool)
+	go func() {
+		p.playRealtime(src)
+		done <- true
+	}()
+
+	// A line from a skewed clock is not held, and a held line is recorded when the input ends
+	// before the clock reaches it.
+	src <- LogModel{date: start + 2, section: "/api"}
+	src <- LogModel{date: start + 3600, section: "/api"}
+	close(src)
+	<-done
+	p.Close()
+
+	if p.early != 1 || len(p.pending) != 0 || p.tick != start+3 {
+		t.Errorf(`playRealtime counted %v early lines and left %v held at tick %v, want 1 and 0 at %v`,
+			p.early, len(p.pending), p.tick, start+3)
+	}
+}
+
+func TestPlayPerSource(t *testing.T) {
+	start := int64(1549573860)
+	stats := make(map[string][]TopKResult)
+	onStats := func(report StatsReport) {
+		if report.tick == start+5 {
+			stats[report.source] = report.sections
+		}
+	}
+	alerts := make(map[string]int)
+	onAlert := func(a Alert) {
+		if a.state == AlertFiring {
+			alerts[a.source] = int(a.value)
+		}
+	}
+
+	p := NewPlayer("", 5, 1, 2)
+	p.AddSink(funcSink{stats: onStats, alert: onAlert})
+	p.perSource = true
+	src := make(chan LogModel)
+	go func() {
+		for _, line := range []LogModel{
+			{date: start, section: "/api", source: "web1"},
+			{date: start, section: "/api", source: "web2"},
+			{date: start + 1, section: "/report", source: "web1"},
+			{date: start + 1, section: "/report", source: "web1"},
+			{date: start + 9, section: "/api", source: "web2"},
+		} {
+			src <- line
+		}
+		close(src)
+	}()
+	p.playLog(src)
+	p.Close()
+
+	wantStats := map[string]int{"": 2, "web1": 2, "web2": 1}
+	for source, want := range wantStats {
+		if len(stats[source]) == 0 || stats[source][0].hits != want {
+			t.Errorf(`Source %q stats top section was %v, want %v hits`, source, stats[source], want)
+		}
+	}
+	wantAlerts := map[string]int{"": 2, "web1": 3}
+	if len(alerts) != len(wantAlerts) {
+		t.Errorf(`Alerts sent for %v, want %v`, alerts, wantAlerts)
+	}
+	for source, want := range wantAlerts {
+		if alerts[source] != want {
+			t.Errorf(`Source %q alert hits were %v, want %v`, source, alerts[source], want)
+		}
+	}
+}
+
+func TestPlayReload(t *testing.T) {
+	start := int64(1549573860)
+	var stats []int64
+	onStats := func(report StatsReport) {
+		stats = append(stats, report.tick)
+	}
+	var alerts []string
+	onAlert := func(a Alert) {
+		if a.state == AlertFiring {
+			alerts = append(alerts, a.rule)
+		}
+	}
+
+	p := NewPlayer("", 10, 5, 10)
+	p.AddSink(funcSink{stats: onStats, alert: onAlert})
+	p.reloads = make(chan Config)
+	src := make(chan LogModel)
+	done := make(chan bool)
+	go func() {
+		p.playLog(src)
+		done <- true
+	}()
+
+	for i := 0; i < 30; i++ {
+		src <- LogModel{date: start, section: "/api"}
+	}
+	src <- LogModel{date: start + 1, section: "/api"}
+
+	// An invalid config is ignored.
+	config := DefaultConfig()
+	config.Inputs = []string{"-"}
+	config.Stats.Interval = 0
+	p.reloads <- config
+
+	// The high traffic rule keeps its history, so alerts with the lower threshold.
+	config.Stats.Interval = 5
+	config.Alert.Rps = 3
+	config.Alert.Window = 10
+	config.Rules = []Rule{{Name: "api", Metric: MetricHits, Filter: map[string]string{"section": "/api"}, Window: 1, Op: ">=", Threshold: 1}}
+	p.reloads <- config
+	src <- LogModel{date: start + 2, section: "/api"}
+	src <- LogModel{date: start + 12, section: "/api"}
+	close(src)
+	<-done
+	p.Close()
+
+	wantAlerts := []string{"high_traffic", "api"}
+	if len(alerts) != len(wantAlerts) || alerts[0] != wantAlerts[0] || alerts[1] != wantAlerts[1] {
+		t.Errorf(`Alerts fired for %v, want %v`, alerts, wantAlerts)
+	}
+	wantStats := []int64{start + 5, start + 10}
+	if len(stats) != len(wantStats) || stats[0] != wantStats[0] || stats[1] != wantStats[1] {
+		t.Errorf(`Stats sent at %v, want %v`, stats, wantStats)
+	}
+}
+
+func TestPlayStop(t *testing.T) {
+	start := int64(1549573860)
+	var alerts []AlertState
+	p := NewPlayer("", 10, 1, 2)
+	p.AddSink(funcSink{alert: func(a Alert) { alerts = append(alerts, a.state) }})
+	src := make(chan LogModel)
+	done := make(chan bool)
+	go func() {
+		p.playLog(src)
+		done <- true
+	}()
+
+	// Playback stops although the input has not ended, and the sinks are written on closing.
+	for i := 0; i < 5; i++ {
+		src <- LogModel{date: start, section: "/api"}
+	}
+	src <- LogModel{date: start + 1, section: "/api"}
+	p.Stop()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf(`playLog did not return after Stop`)
+	}
+	p.Stop()
+	p.Close()
+
+	if len(alerts) != 1 || alerts[0] != AlertFiring {
+		t.Errorf(`Player sent alerts %v before stopping, want [firing]`, alerts)
+	}
 }
@@ -1,28 +1,42 @@
 /*
-`Reader` is responsible for ingesting the contents of a csv HTTP access log file and parsing
-it into suitable format for downstream processes to handle. It is run on a separate thread
-(goroutine) and reads the contents into a buffer before being processed. From the example
-input file it can be observed that logs are not in a strict order, but it is assumed that
-they are in a timely order. To handle this a priority queue has been implemented, of size 50
-by default, which is filled to capacity before sending the earliest log line back to the
-`Player`. This is effectively a moving window through the csv file which assumes that
-timestamp T(n+51) onwards will not be earlier than any time within T(n) to T(n+50).
+`Reader` is responsible for ingesting the contents of a HTTP access log file and parsing
+it into suitable format for downstream processes to handle. Each line is parsed by a `Parser`
+for the chosen log format. It is run on a separate thread (goroutine) and reads the contents
+into a buffer before being processed. From the example input file it can be observed that
+logs are not in a strict order, but it is assumed that they are in a timely order. To handle
+this each line passes through a `ReorderBuffer`, which holds lines until no earlier line is
+expected, up to a maximum lateness of 2 seconds by default, before sending the earliest log
+line back to the `Player`. When the buffer is driven by a clock, the `Reader` also sends a
+heartbeat each second, so that a `Merger` need not wait for a quiet source to send a line.
+
+Several input files may be read in a single run. Each is read by a `Reader` of its own and
+they are merged by timestamp, so files whose times overlap, such as the logs of each worker of a
+server, are ordered line by line. In follow mode the input file with the latest first line is
+kept open and new lines are read as they are appended, in the manner of `tail -F`. Like `tail -F`, only lines appended after the `Reader` starts are read when following,
+unless it is asked to read the inputs from the start. Log rotation by rename or truncation is
+handled by the `Follower`.
+
+Malformed lines never stop the `Reader`. Each is counted, reported with its line number and
+optionally written to a rejects file. In strict mode the first malformed line is fatal instead.
 */
 package main
 
 import (
-	"container/heap"
-	"encoding/csv"
+	"bufio"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	defaultBufferSize        = 50
-	defaultPriorityQueueSize = 50
+	defaultBufferSize      = 50
+	defaultMaxLateness     = 2
+	defaultReorderCapacity = 100000
+	maxRecordLines         = 100 // lines a record may span, so a stray quote cannot swallow a log
 )
 
 type RequestData struct {
@@ -44,109 +58,224 @@ type LogModel struct {
 	endpoint   string
 	section    string
 	protocol   string
+	referer    string
+	userAgent  string
+	source     string
+	latency    float64 // seconds taken to serve the request
+	timed      bool    // the log line includes the latency
+	heartbeat  bool    // carries no request, only that the source will send no line earlier than date
+}
+
+// Attribute returns the value of a LogModel field by name. The names match the fields of the
+// JSON log format, along with the section and source.
+func (l LogModel) Attribute(name string) (string, bool) {
+	switch name {
+	case "remotehost":
+		return l.remoteHost, true
+	case "rfc931":
+		return l.authServer, true
+	case "authuser":
+		return l.authUser, true
+	case "date":
+		return strconv.FormatInt(l.date, 10), true
+	case "request":
+		return l.request, true
+	case "status":
+		return strconv.Itoa(l.status), true
+	case "bytes":
+		return strconv.Itoa(l.bytes), true
+	case "method":
+		return l.method, true
+	case "endpoint":
+		return l.endpoint, true
+	case "section":
+		return l.section, true
+	case "protocol":
+		return l.protocol, true
+	case "referer":
+		return l.referer, true
+	case "useragent":
+		return l.userAgent, true
+	case "source":
+		return l.source, true
+	case "request_time":
+		if !l.timed {
+			return "", true
+		}
+		return strconv.FormatFloat(l.latency, 'f', -1, 64), true
+	default:
+		return "", false
+	}
+}
+
+// isAttribute reports whether name is a LogModel attribute.
+func isAttribute(name string) bool {
+	_, found := LogModel{}.Attribute(name)
+	return found
 }
 
 type Reader struct {
-	filePath string         // input csv file path
-	logMap   map[string]int // maps a request header to the index within a log line
-	buff     chan []string  // channel buffer for lines read from csv
+	source    string        // name of the source, such as a host, the inputs are logged by
+	inputs    []string      // input log file paths, merged by timestamp
+	follow    bool          // keep reading as the last input file grows
+	fromStart bool          // in follow mode, read the inputs from the start rather than only new lines
+	newParser ParserFactory // returns a parser for each input file
+	lateness  int64         // seconds a log line may arrive after a later line
+	capacity  int           // maximum number of log lines held for reordering
+	clock     Clock         // releases held lines and sends heartbeats as time passes, nil to only use log timestamps
+	strict    bool          // stop on the first line which cannot be read or parsed
+	rejects   *RejectLog    // records lines which cannot be parsed
+	rejected  int           // number of lines rejected by this reader
 }
 
-// NewReader returns a new instance of the Reader.
+// NewReader returns a new instance of the Reader for a csv log.
 func NewReader(filePath string) *Reader {
 	return &Reader{
-		filePath: filePath,
-		logMap:   make(map[string]int),
-		buff:     make(chan []string, 10),
+		inputs:    []string{filePath},
+		newParser: func() Parser { return NewCSVParser() },
+		lateness:  defaultMaxLateness,
+		capacity:  defaultReorderCapacity,
+		rejects:   NewRejectLog(nil),
 	}
 }
 
-// Process reads the contents of the input file and outputs the results to the out channel.
-// Each line is parsed into a LogModel struct. A priority queue is maintained, with the
-// earliest timestamp at the front, to handle the input not being in a strict time order.
+// Process reads the contents of the input files and outputs the results to the out channel.
+// A reorder buffer is maintained to handle the input not being in a strict time order.
 func (r *Reader) Process(out chan LogModel) {
-	queue := make(PriorityQueue, 0)
-	header := true
-	readBuffer := make(chan []string, defaultBufferSize)
+	inputs := orderInputs(r.inputs, r.newParser)
+	if r.follow && !r.fromStart && len(inputs) > 1 {
+		// Only new lines are read, and those are only appended to the latest file.
+		inputs = inputs[len(inputs)-1:]
+	}
+	if len(inputs) > 1 {
+		r.merge(inputs, out)
+		return
+	}
 
-	go r.Read(readBuffer)
+	buffer := NewReorderBuffer(r.lateness, r.capacity)
+	readBuffer := make(chan LogModel, defaultBufferSize)
+
+	// When following a log, release lines as time passes even if no new lines arrive.
+	var ticks <-chan time.Time
+	if r.clock != nil {
+		ticker := r.clock.NewTicker(time.Second)
+		defer ticker.Stop()
+		ticks = ticker.C()
+	}
+
+	go r.Read(inputs, readBuffer)
 	for {
-		line, ok := <-readBuffer
-		for {
-			// Send the next item in the priority queue if the chosen size has been reached.
-			if queue.Len() < defaultPriorityQueueSize {
-				break
+		heartbeat := false
+		select {
+		case line, ok := <-readBuffer:
+			if !ok {
+				// Files fully read, send remaining logs in the buffer
+				for line, ok := buffer.Flush(); ok; line, ok = buffer.Flush() {
+					out <- line
+				}
+				if r.rejected > 0 {
+					fmt.Fprintf(os.Stderr, "%v malformed log lines rejected.\n", r.rejected)
+				}
+				if buffer.Dropped() > 0 {
+					fmt.Fprintf(os.Stderr, "%v access requests dropped as later than the maximum lateness of %vs.\n", buffer.Dropped(), r.lateness)
+				}
+				close(out)
+				return
 			}
-			entry := heap.Pop(&queue).(*LogItem)
-			out <- entry.value.(LogModel)
-		}
-		if ok {
-			if header {
-				// Process header
-				r.parseHeader(line)
-				header = false
-			} else {
-				// Process log line
-				logModel := r.parseLog(line)
-				heap.Push(&queue, &LogItem{value: logModel, priority: logModel.date})
+			if !buffer.Push(line) && buffer.Dropped() == 1 {
+				fmt.Fprintf(os.Stderr, "Access request dropped as too late, further drops are counted. Request time %v, maximum lateness %vs. %v\n", line.date, r.lateness, line)
 			}
-		} else if queue.Len() > 0 {
-			// File fully read, send remaining logs in priority queue
-			entry := heap.Pop(&queue).(*LogItem)
-			out <- entry.value.(LogModel)
-		} else {
-			close(out)
-			return
+		case now := <-ticks:
+			buffer.Advance(now.Unix() - r.lateness)
+			heartbeat = true
 		}
+
+		// Send each line which has passed the watermark.
+		for line, ok := buffer.Pop(); ok; line, ok = buffer.Pop() {
+			out <- line
+		}
+		if heartbeat {
+			out <- LogModel{date: buffer.Released(), source: r.source, heartbeat: true}
+		}
+	}
+}
+
+// merge reads each input with a Reader of its own, following the last, and merges their lines
+// by timestamp.
+func (r *Reader) merge(inputs []string, out chan LogModel) {
+	readers := make([]LogSource, len(inputs))
+	for index, path := range inputs {
+		reader := *r
+		reader.inputs = []string{path}
+		reader.follow = r.follow && index == len(inputs)-1
+		readers[index] = &reader
 	}
+	NewMerger(readers).Process(out)
+}
+
+// Read ingests each input file in turn, parses each line into a LogModel struct and sends
+// the result to a buffer channel. In follow mode this only returns if the last file can no
+// longer be read.
+func (r *Reader) Read(inputs []string, buffer chan LogModel) {
+	for index, path := range inputs {
+		r.readInput(path, r.follow && index == len(inputs)-1, buffer)
+	}
+	close(buffer)
 }
 
-// Read ingests each line from the csv file and sends the result to a buffer channel
-func (r *Reader) Read(buffer chan []string) {
-	input, err := os.Open(r.filePath)
+// readInput parses each line of a single input file and sends the result to a buffer channel.
+// Lines which cannot be parsed are rejected, or in strict mode stop the programme.
+func (r *Reader) readInput(path string, follow bool, buffer chan LogModel) {
+	parser := r.newParser()
+	if follow && !r.fromStart {
+		readHeader(path, parser)
+	}
+	input, err := openInput(path, follow, r.fromStart)
 	if err != nil {
-		log.Fatal("Unable to read file " + r.filePath)
+		if r.strict {
+			log.Fatalf("Unable to read file %s: %v", path, err)
+		}
+		fmt.Fprintf(os.Stderr, "Unable to read file %s: %v\n", path, err)
+		return
 	}
 	defer input.Close()
 
-	dec := csv.NewReader(input)
-	for {
-		record, err := dec.Read()
+	multiline, _ := parser.(MultilineParser)
+	dec := bufio.NewReader(input)
+	for lineNumber := 1; ; lineNumber++ {
+		first := lineNumber
+		text, err := dec.ReadString('\n')
+		// A record, such as a csv line with a quoted newline, may continue onto the next lines.
+		for lines := 1; err == nil && multiline != nil && lines < maxRecordLines && multiline.Continues(text); lines++ {
+			var more string
+			more, err = dec.ReadString('\n')
+			text += more
+			lineNumber++
+		}
+		text = strings.TrimRight(text, "\r\n")
+		if len(text) > 0 {
+			line, parseErr := parser.Parse(text)
+			if parseErr == nil {
+				line.source = r.source
+				buffer <- line
+			} else if parseErr != errSkipLine {
+				if r.strict {
+					log.Fatalf("Unable to parse %s:%v: %v", path, first, parseErr)
+				}
+				r.rejected++
+				r.rejects.Reject(path, first, text, parseErr)
+			}
+		}
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			log.Fatal(err)
+			if r.strict {
+				log.Fatalf("Unable to read file %s: %v", path, err)
+			}
+			fmt.Fprintf(os.Stderr, "Unable to read file %s after line %v: %v\n", path, lineNumber, err)
+			break
 		}
-		buffer <- record
 	}
-	close(buffer)
-}
-
-// parseheader takes the csv header and fills in the logMap which associates a header
-// string with an index.
-func (r *Reader) parseHeader(header []string) {
-	for index, entry := range header {
-		r.logMap[entry] = index
-	}
-}
-
-// parseLog parses a line of the log file and returns a LogModel struct.
-func (r *Reader) parseLog(fields []string) LogModel {
-	log := LogModel{}
-	log.remoteHost = fields[r.logMap["remotehost"]]
-	log.authServer = fields[r.logMap["rfc931"]]
-	log.authUser = fields[r.logMap["authuser"]]
-	t, _ := strconv.Atoi(fields[r.logMap["date"]])
-	log.date = int64(t)
-	log.status, _ = strconv.Atoi(fields[r.logMap["status"]])
-	log.bytes, _ = strconv.Atoi(fields[r.logMap["bytes"]])
-	log.request = fields[r.logMap["request"]]
-	requestData := parseRequest(log.request)
-	log.method = requestData.method
-	log.endpoint = requestData.endpoint
-	log.section = requestData.section
-	log.protocol = requestData.protocol
-	return log
 }
 
 // parseRequest parses the request string and extracts individual components.
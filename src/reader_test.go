@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -47,45 +51,123 @@ func TestProcess(t *testing.T) {
 	go r.Process(out)
 }
 
-func TestParseHeader(t *testing.T) {
-	var tests = []struct {
-		input []string
-		want  map[string]int
-	}{
-		{[]string{"remotehost", "rfc931", "authuser", "date", "request", "status", "bytes"},
-			map[string]int{"remotehost": 0, "rfc931": 1, "authuser": 2, "date": 3, "request": 4, "status": 5, "bytes": 6}},
-		{[]string{"request", "authuser", "remotehost", "status", "bytes", "date", "rfc931"},
-			map[string]int{"remotehost": 2, "rfc931": 6, "authuser": 1, "date": 5, "request": 0, "status": 3, "bytes": 4}},
+func TestProcessBurst(t *testing.T) {
+	// A burst of requests in one second, followed by a request from the previous second.
+	var log strings.Builder
+	log.WriteString(testHeader)
+	for i := 0; i < 500; i++ {
+		log.WriteString(fmt.Sprintf(`"10.0.0.1","-","apache",1549573861,"GET /api/%v HTTP/1.0",200,1`+"\n", i))
 	}
+	log.WriteString(`"10.0.0.1","-","apache",1549573860,"GET /late HTTP/1.0",200,1` + "\n")
+	path := filepath.Join(t.TempDir(), "burst.csv")
+	appendFile(t, path, log.String())
 
-	r := NewReader("")
-	for _, test := range tests {
-		r.parseHeader(test.input)
-		if !cmp.Equal(r.logMap, test.want) {
-			t.Errorf(`reader.parseHeader(%q) set logMap to %q, want %q`, test.input, r.logMap, test.want)
+	r := NewReader(path)
+	out := make(chan LogModel)
+	go r.Process(out)
+
+	count := 0
+	prevTime := int64(0)
+	for line := range out {
+		if line.date < prevTime {
+			t.Errorf(`Process out of order. Previous time %v, got %v`, prevTime, line.date)
 		}
+		prevTime = line.date
+		count++
+	}
+	if count != 501 {
+		t.Errorf(`Process output %v lines, want %v`, count, 501)
 	}
 }
 
-func TestParseLog(t *testing.T) {
-	var tests = []struct {
-		header []string
-		log    []string
-		want   LogModel
-	}{
-		{[]string{"remotehost", "rfc931", "authuser", "date", "request", "status", "bytes"},
-			[]string{"10.0.0.2", "-", "apache", "1549573860", "GET /api/user HTTP/1.0", "200", "1234"},
-			LogModel{"10.0.0.2", "-", "apache", 1549573860, 200, 1234, "GET /api/user HTTP/1.0", "GET", "/api/user", "/api", "HTTP/1.0"}},
-		{[]string{"bytes", "remotehost", "authuser", "rfc931", "status", "request", "date"},
-			[]string{"1194", "10.0.0.5", "apache", "-", "500", "POST /report HTTP/1.0", "1549574134"},
-			LogModel{"10.0.0.5", "-", "apache", 1549574134, 500, 1194, "POST /report HTTP/1.0", "POST", "/report", "/report", "HTTP/1.0"}},
+func TestProcessHeartbeat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.csv")
+	appendFile(t, path, testHeader)
+	start := int64(1549573860)
+	clock := newFakeClock(start)
+	r := NewReader(path)
+	r.source = "web1"
+	r.follow = true
+	r.clock = clock
+	out := make(chan LogModel)
+	go r.Process(out)
+
+	// A quiet followed source sends a heartbeat trailing the clock by the maximum lateness.
+	go clock.Advance(time.Second)
+	select {
+	case line := <-out:
+		if !line.heartbeat || line.date != start+1-defaultMaxLateness || line.source != "web1" {
+			t.Errorf(`Reader sent %+v, want a heartbeat for web1 at %v`, line, start+1-defaultMaxLateness)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf(`Reader sent no heartbeat`)
 	}
+}
 
-	r := NewReader("")
-	for _, test := range tests {
-		r.parseHeader(test.header)
-		if got := r.parseLog(test.log); got != test.want {
-			t.Errorf(`parseLog(%s) returned %v, want %v`, test.log, got, test.want)
+func TestProcessMalformed(t *testing.T) {
+	var log strings.Builder
+	log.WriteString(testHeader)
+	log.WriteString(`"10.0.0.1","-","apache",1549573860,"GET /a HTTP/1.0",200,1` + "\n")
+	log.WriteString(`"10.0.0.1","-","apache"` + "\n")
+	log.WriteString(`"10.0.0.1","-","apache",yesterday,"GET /b HTTP/1.0",200,1` + "\n")
+	log.WriteString(`"10.0.0.1","-","apache",1549573861,"GET /c HTTP/1.0",200,1` + "\n")
+	path := filepath.Join(t.TempDir(), "malformed.csv")
+	appendFile(t, path, log.String())
+
+	var rejected strings.Builder
+	var report strings.Builder
+	r := NewReader(path)
+	r.rejects = NewRejectLog(&rejected)
+	r.rejects.report = &report
+	out := make(chan LogModel)
+	go r.Process(out)
+
+	var got []string
+	for line := range out {
+		got = append(got, line.section)
+	}
+	if want := []string{"/a", "/c"}; !cmp.Equal(got, want) {
+		t.Errorf(`Process output sections %q, want %q`, got, want)
+	}
+
+	if want := `"10.0.0.1","-","apache"` + "\n" + `"10.0.0.1","-","apache",yesterday,"GET /b HTTP/1.0",200,1` + "\n"; rejected.String() != want {
+		t.Errorf(`Rejected lines were %q, want %q`, rejected.String(), want)
+	}
+	for _, want := range []string{path + ":3:", path + ":4:"} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf(`Reject report %q does not contain %q`, report.String(), want)
 		}
 	}
+	if got := r.rejects.Count(); got != 2 {
+		t.Errorf(`rejects.Count() returned %v, want %v`, got, 2)
+	}
+}
+
+func TestProcessMultiline(t *testing.T) {
+	var log strings.Builder
+	log.WriteString(testHeader)
+	log.WriteString(`"10.0.0.1","-","first` + "\n" + `second ""quoted""",1549573860,"GET /a HTTP/1.0",200,1` + "\n")
+	log.WriteString(`"10.0.0.1","-","apache",1549573861,"GET /b HTTP/1.0",200,1` + "\n")
+	log.WriteString(`"10.0.0.1","-","apache",1549573862,"GET /c HTTP/1.0` + "\n")
+	path := filepath.Join(t.TempDir(), "multiline.csv")
+	appendFile(t, path, log.String())
+
+	var report strings.Builder
+	r := NewReader(path)
+	r.rejects = NewRejectLog(nil)
+	r.rejects.report = &report
+	out := make(chan LogModel)
+	go r.Process(out)
+
+	// A quoted field may contain a newline, and a field left open at the end is rejected.
+	var got []string
+	for line := range out {
+		got = append(got, line.authUser+" "+line.section)
+	}
+	if want := []string{"first\nsecond \"quoted\" /a", "apache /b"}; !cmp.Equal(got, want) {
+		t.Errorf(`Process output %q, want %q`, got, want)
+	}
+	if !strings.Contains(report.String(), path+":5:") || r.rejects.Count() != 1 {
+		t.Errorf(`Reject report %q, want a single reject of line 5`, report.String())
+	}
 }
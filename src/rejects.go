@@ -0,0 +1,60 @@
+/*
+`RejectLog` collects the log lines which could not be parsed. Each rejected line is reported on
+stderr with its file and line number and, if a rejects file is chosen, written unchanged to that
+file so that it can be inspected or reprocessed later. A single `RejectLog` is shared by every
+`Reader`, so access is synchronised.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+type RejectLog struct {
+	mu     sync.Mutex
+	out    io.Writer // destination for rejected lines, nil to only report them
+	report io.Writer // destination for error reports
+	count  int       // number of lines rejected
+}
+
+// NewRejectLog returns a new instance of the RejectLog which writes rejected lines to out.
+func NewRejectLog(out io.Writer) *RejectLog {
+	return &RejectLog{
+		out:    out,
+		report: os.Stderr,
+	}
+}
+
+// Reject records a line which could not be parsed.
+func (r *RejectLog) Reject(path string, lineNumber int, line string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.count++
+	fmt.Fprintf(r.report, "Rejected %s:%v: %v\n", path, lineNumber, err)
+	if r.out != nil {
+		fmt.Fprintln(r.out, line)
+	}
+}
+
+// Close closes the rejects file, if any. Lines rejected afterwards are only reported.
+func (r *RejectLog) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	closer, ok := r.out.(io.Closer)
+	r.out = nil
+	if !ok {
+		return nil
+	}
+	return closer.Close()
+}
+
+// Count returns the number of lines rejected.
+func (r *RejectLog) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count
+}
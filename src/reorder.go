@@ -0,0 +1,103 @@
+/*
+`ReorderBuffer` restores the time order of log lines which arrive slightly out of order. Lines
+are held in a priority queue, with the earliest timestamp at the front, until the watermark
+passes them. The watermark trails the latest timestamp seen by the maximum lateness, so a line
+is only released once a line at least that many seconds later has arrived. A line which
+arrives earlier than a line already released is too late to be placed in order and is dropped.
+To bound memory, once the buffer holds its capacity of lines the earliest line is released
+regardless of the watermark.
+
+When following a live log the watermark may also be advanced by the clock, so that lines are
+released during quiet periods without waiting for later lines to arrive. A line which then
+arrives earlier than the watermark is too late and is dropped, so the `Reader` can promise a
+`Merger` that no earlier line will follow.
+*/
+package main
+
+import "container/heap"
+
+type ReorderBuffer struct {
+	queue     PriorityQueue
+	lateness  int64 // seconds a line may arrive after a later line
+	capacity  int   // maximum number of lines held
+	watermark int64 // lines up to and including this second may be released
+	released  int64 // lines before this second are too late, as a later line was released or the clock passed it
+	dropped   int   // number of lines dropped as too late
+}
+
+// NewReorderBuffer returns a new instance of the ReorderBuffer.
+func NewReorderBuffer(lateness int64, capacity int) *ReorderBuffer {
+	return &ReorderBuffer{
+		queue:    make(PriorityQueue, 0),
+		lateness: lateness,
+		capacity: capacity,
+	}
+}
+
+// Push adds a line to the buffer. It returns false if the line is too late and was dropped.
+func (b *ReorderBuffer) Push(line LogModel) bool {
+	if line.date < b.released {
+		b.dropped++
+		return false
+	}
+	heap.Push(&b.queue, &LogItem{value: line, priority: line.date})
+	if t := line.date - b.lateness - 1; t > b.watermark {
+		b.watermark = t
+	}
+	return true
+}
+
+// Advance moves the watermark forward to the given second as time passes, such as by the clock.
+// Lines earlier than the watermark are then too late.
+func (b *ReorderBuffer) Advance(t int64) {
+	if t > b.watermark {
+		b.watermark = t
+	}
+	if t > b.released {
+		b.released = t
+	}
+}
+
+// Pop returns the earliest line if it has passed the watermark or the buffer is over capacity.
+func (b *ReorderBuffer) Pop() (LogModel, bool) {
+	if b.queue.Len() == 0 {
+		return LogModel{}, false
+	}
+	if b.queue[0].priority > b.watermark && b.queue.Len() <= b.capacity {
+		return LogModel{}, false
+	}
+	return b.release(), true
+}
+
+// Flush returns the earliest line regardless of the watermark, once the input is finished.
+func (b *ReorderBuffer) Flush() (LogModel, bool) {
+	if b.queue.Len() == 0 {
+		return LogModel{}, false
+	}
+	return b.release(), true
+}
+
+// release removes and returns the earliest line.
+func (b *ReorderBuffer) release() LogModel {
+	line := heap.Pop(&b.queue).(*LogItem).value.(LogModel)
+	if line.date > b.released {
+		b.released = line.date
+	}
+	return line
+}
+
+// Released returns the second before which lines are too late. No line earlier than it will be
+// released.
+func (b *ReorderBuffer) Released() int64 {
+	return b.released
+}
+
+// Len returns the number of lines held in the buffer.
+func (b *ReorderBuffer) Len() int {
+	return b.queue.Len()
+}
+
+// Dropped returns the number of lines dropped as too late.
+func (b *ReorderBuffer) Dropped() int {
+	return b.dropped
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// drain pops every line ready to be released from the buffer and returns their timestamps.
+func drain(b *ReorderBuffer) []int64 {
+	var dates []int64
+	for line, ok := b.Pop(); ok; line, ok = b.Pop() {
+		dates = append(dates, line.date)
+	}
+	return dates
+}
+
+func TestReorderBuffer(t *testing.T) {
+	b := NewReorderBuffer(2, 100)
+
+	var tests = []struct {
+		push     int64
+		accepted bool
+		want     []int64
+	}{
+		{10, true, nil},
+		{12, true, nil},
+		{11, true, nil},
+		{13, true, []int64{10}},
+		{10, true, []int64{10}},
+		{16, true, []int64{11, 12, 13}},
+		{12, false, nil},
+		{14, true, nil},
+	}
+	for _, test := range tests {
+		if got := b.Push(LogModel{date: test.push}); got != test.accepted {
+			t.Errorf(`Push(%v) returned %v, want %v`, test.push, got, test.accepted)
+		}
+		if got := drain(b); !cmp.Equal(got, test.want) {
+			t.Errorf(`After Push(%v) released %v, want %v`, test.push, got, test.want)
+		}
+	}
+
+	if got := b.Dropped(); got != 1 {
+		t.Errorf(`Dropped() returned %v, want %v`, got, 1)
+	}
+
+	// The watermark can be advanced without new lines.
+	b.Advance(16)
+	if got := drain(b); !cmp.Equal(got, []int64{14, 16}) {
+		t.Errorf(`After Advance(16) released %v, want %v`, got, []int64{14, 16})
+	}
+	if got := b.Len(); got != 0 {
+		t.Errorf(`Len() returned %v, want %v`, got, 0)
+	}
+
+	// Once the clock has advanced the watermark, earlier lines are too late.
+	b.Advance(20)
+	if b.Push(LogModel{date: 19}) || !b.Push(LogModel{date: 20}) || b.Released() != 20 {
+		t.Errorf(`After Advance(20) Push(19) was accepted or Push(20) dropped, released %v`, b.Released())
+	}
+}
+
+func TestReorderBufferCapacity(t *testing.T) {
+	b := NewReorderBuffer(60, 3)
+	for _, date := range []int64{5, 3, 4, 1} {
+		b.Push(LogModel{date: date})
+	}
+	// Over capacity, the earliest line is released regardless of the watermark.
+	if got := drain(b); !cmp.Equal(got, []int64{1}) {
+		t.Errorf(`Over capacity released %v, want %v`, got, []int64{1})
+	}
+	if b.Push(LogModel{date: 0}) {
+		t.Errorf(`Push(0) accepted a line earlier than one already released`)
+	}
+
+	var flushed []int64
+	for line, ok := b.Flush(); ok; line, ok = b.Flush() {
+		flushed = append(flushed, line.date)
+	}
+	if want := []int64{3, 4, 5}; !cmp.Equal(flushed, want) {
+		t.Errorf(`Flush() released %v, want %v`, flushed, want)
+	}
+}
@@ -0,0 +1,640 @@
+/*
+A `Rule` defines an alert condition evaluated by the `Monitor`. Each rule totals a metric, such
+as the number of hits or bytes served, over a sliding window of log lines matching its filter.
+When the total passes the rule's threshold an alert of the rule's severity is fired, and when
+it no longer does the alert recovers. A warning rule may also have a critical threshold, beyond
+its threshold, at which the alert escalates to critical and below which it returns to a warning.
+A rule may group lines by any `LogModel` attribute, in which case a separate window and alert is
+kept for each value, such as each section or host.
+
+An error rate rule instead keeps the percentage of lines with a status in its class, such as
+5xx, out of all the lines it matches. It only fires once the window holds a minimum number of
+requests, so that a handful of errors during a quiet period is not reported.
+
+A latency rule compares a percentile of the request times of the lines in its window, such as
+the 99th, against a threshold in seconds. Lines without a request time are not counted.
+
+A rule which alerts when its total falls below a floor, such as low traffic, is not compared
+until its window is full, and not for a warm-up period after the monitor starts, which defaults
+to the window. Otherwise the partial window at startup would always be below the floor.
+
+To avoid a flood of alerts when the total hovers around the threshold, a rule may recover at a
+separate threshold, and may require its threshold to be passed for a number of seconds before
+firing, and its recover threshold before recovering. A rule whose alert changes state more than
+a limit within the flap window is flapping, and its alerts are suppressed until it settles.
+
+Rather than a fixed threshold, a rule may compare its total against a learned `Baseline`. The
+threshold is then a number of standard deviations from the baseline's mean, and the comparison
+picks spikes (>=), drops (<=) or both (<>).
+
+Rules can be given in the config file as JSON objects, or on the command line as comma
+separated key=value pairs with the same names, for example:
+
+	name=api_errors,metric=hits,filter=status:5xx;section:/api,window=60,op=>=,threshold=10
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	MetricHits      = "hits"
+	MetricBytes     = "bytes"
+	MetricErrorRate = "error_rate"
+	MetricLatency   = "latency"
+)
+
+const (
+	defaultErrorStatus = "5xx"
+	defaultMaxGroups   = 1000
+	defaultPercentile  = 99
+	defaultFlapWindow  = 600
+)
+
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityCritical
+)
+
+// String returns the name of the severity.
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityCritical:
+		return "critical"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// Colour returns the colour alerts of the severity are displayed in.
+func (s Severity) Colour() Colour {
+	if s == SeverityCritical {
+		return ColourRed
+	}
+	return ColourYellow
+}
+
+// ParseSeverity returns the severity with the given name.
+func ParseSeverity(name string) (Severity, error) {
+	switch name {
+	case "warning":
+		return SeverityWarning, nil
+	case "critical":
+		return SeverityCritical, nil
+	default:
+		return 0, fmt.Errorf("unknown severity %q, want warning or critical", name)
+	}
+}
+
+// UnmarshalJSON reads a severity from its name.
+func (s *Severity) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return fmt.Errorf("severity must be a string")
+	}
+	severity, err := ParseSeverity(name)
+	if err != nil {
+		return err
+	}
+	*s = severity
+	return nil
+}
+
+// MarshalJSON writes a severity as its name.
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+type Rule struct {
+	Name        string            `json:"name"`              // unique name of the rule
+	Description string            `json:"description"`       // describes the alert in messages, the name is used if empty
+	Metric      string            `json:"metric"`            // metric totalled over the window: hits, bytes, error_rate or latency
+	Filter      map[string]string `json:"filter"`            // attribute values a line must match to be counted
+	GroupBy     string            `json:"group"`             // attribute to keep a separate window for, empty for all lines
+	Window      int               `json:"window"`            // duration of the window in seconds
+	Op          string            `json:"op"`                // comparison of the total against the threshold
+	Threshold   float64           `json:"threshold"`         // threshold the total is compared against
+	PerSecond   bool              `json:"rate"`              // the threshold is an average per second over the window
+	Severity    Severity          `json:"severity"`          // severity of alerts fired by the rule
+	Critical    float64           `json:"critical"`          // threshold at which a warning escalates to critical, 0 for a single severity
+	Status      string            `json:"status"`            // status class counted as an error by an error rate rule
+	MinRequests int               `json:"min_requests"`      // requests needed in the window before an error rate or latency rule fires
+	Percentile  float64           `json:"percentile"`        // percentile of latency compared by a latency rule, 0 for the default of 99
+	MaxGroups   int               `json:"max_groups"`        // maximum number of groups monitored at once, 0 for the default
+	Baseline    string            `json:"baseline"`          // baseline the total is compared against, ewma or daily, empty for a fixed threshold
+	HalfLife    int               `json:"half_life"`         // seconds after which a value's weight in the baseline halves, 0 for the default
+	Warmup      int               `json:"warmup"`            // seconds after the monitor starts before the rule fires, 0 for the default
+	Recover     float64           `json:"recover_threshold"` // threshold the total must pass back over to recover, 0 for the threshold
+	For         int               `json:"for"`               // seconds the threshold must be passed before firing
+	RecoverFor  int               `json:"recover_for"`       // seconds the recover threshold must be passed before recovering
+	FlapLimit   int               `json:"flap_limit"`        // changes of state within the flap window above which alerts are suppressed, 0 to disable
+	FlapWindow  int               `json:"flap_window"`       // seconds over which changes of state are counted, 0 for the default
+}
+
+// defaultRule returns a rule with the default settings used when a setting is not given.
+func defaultRule() Rule {
+	return Rule{Metric: MetricHits, Op: ">=", Severity: SeverityWarning}
+}
+
+// UnmarshalJSON reads a rule from JSON, using the default for settings which are not given.
+func (r *Rule) UnmarshalJSON(data []byte) error {
+	type rule Rule
+	decoded := rule(defaultRule())
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&decoded); err != nil {
+		return err
+	}
+	*r = Rule(decoded)
+	return nil
+}
+
+// HighTrafficRule returns the rule which alerts when the average number of requests per
+// second over the window reaches rps.
+func HighTrafficRule(rps int, window int) Rule {
+	return Rule{
+		Name:        "high_traffic",
+		Description: "High traffic",
+		Metric:      MetricHits,
+		Window:      window,
+		Op:          ">=",
+		Threshold:   float64(rps),
+		PerSecond:   true,
+		Severity:    SeverityCritical,
+	}
+}
+
+// HighBandwidthRule returns the rule which alerts when the average number of bytes served per
+// second over the window reaches bps.
+func HighBandwidthRule(bps int64, window int) Rule {
+	return Rule{
+		Name:        "high_bandwidth",
+		Description: "High bandwidth",
+		Metric:      MetricBytes,
+		Window:      window,
+		Op:          ">=",
+		Threshold:   float64(bps),
+		PerSecond:   true,
+		Severity:    SeverityCritical,
+	}
+}
+
+// SectionTrafficRule returns the rule which alerts when the average number of requests per
+// second over the window for any single value of the attribute, section or endpoint, reaches rps.
+func SectionTrafficRule(rps int, attribute string, window int) Rule {
+	return Rule{
+		Name:        attribute + "_traffic",
+		Description: "High traffic",
+		Metric:      MetricHits,
+		GroupBy:     attribute,
+		Window:      window,
+		Op:          ">=",
+		Threshold:   float64(rps),
+		PerSecond:   true,
+		Severity:    SeverityCritical,
+	}
+}
+
+// ErrorRateRule returns the rule which alerts when the percentage of requests with a status
+// in the given class over the window reaches percent, once there are at least minRequests.
+func ErrorRateRule(name string, description string, status string, percent float64, minRequests int, window int) Rule {
+	return Rule{
+		Name:        name,
+		Description: description,
+		Metric:      MetricErrorRate,
+		Window:      window,
+		Op:          ">=",
+		Threshold:   percent,
+		Severity:    SeverityCritical,
+		Status:      status,
+		MinRequests: minRequests,
+	}
+}
+
+// HighLatencyRule returns the rule which alerts when the given percentile of request times over
+// the window reaches latency seconds.
+func HighLatencyRule(percentile float64, latency float64, window int) Rule {
+	return Rule{
+		Name:        "high_latency",
+		Description: "High latency",
+		Metric:      MetricLatency,
+		Window:      window,
+		Op:          ">=",
+		Threshold:   latency,
+		Severity:    SeverityCritical,
+		Percentile:  percentile,
+	}
+}
+
+// LowTrafficRule returns the rule which alerts when the average number of requests per second
+// over the window falls below rps.
+func LowTrafficRule(rps float64, window int) Rule {
+	return Rule{
+		Name:        "low_traffic",
+		Description: "Low traffic",
+		Metric:      MetricHits,
+		Window:      window,
+		Op:          "<",
+		Threshold:   rps,
+		PerSecond:   true,
+		Severity:    SeverityCritical,
+	}
+}
+
+// TrafficAnomalyRule returns the rule which alerts when the number of requests over the window
+// is more than sigma standard deviations above or below the baseline.
+func TrafficAnomalyRule(sigma float64, baseline string, window int) Rule {
+	return Rule{
+		Name:        "traffic_anomaly",
+		Description: "Traffic anomaly",
+		Metric:      MetricHits,
+		Window:      window,
+		Op:          "<>",
+		Threshold:   sigma,
+		Severity:    SeverityCritical,
+		Baseline:    baseline,
+	}
+}
+
+// Validate checks that the rule is complete and refers to known metrics and attributes.
+func (r Rule) Validate() error {
+	if len(r.Name) == 0 {
+		return fmt.Errorf("rule has no name")
+	}
+	if r.Metric != MetricHits && r.Metric != MetricBytes && r.Metric != MetricErrorRate && r.Metric != MetricLatency {
+		return fmt.Errorf("rule %q has unknown metric %q, want hits, bytes, error_rate or latency", r.Name, r.Metric)
+	}
+	if r.Metric == MetricErrorRate {
+		if !isStatusClass(r.statusClass()) {
+			return fmt.Errorf("rule %q status must be a status class such as 5xx", r.Name)
+		}
+		if r.Threshold < 0 || r.Threshold > 100 {
+			return fmt.Errorf("rule %q threshold must be a percentage between 0 and 100", r.Name)
+		}
+		if r.PerSecond {
+			return fmt.Errorf("rule %q error rate cannot be a rate per second", r.Name)
+		}
+	} else if len(r.Status) > 0 {
+		return fmt.Errorf("rule %q status is only used by the error_rate metric", r.Name)
+	}
+	if r.Metric == MetricLatency {
+		if r.Percentile < 0 || r.Percentile > 100 {
+			return fmt.Errorf("rule %q percentile must be between 0 and 100", r.Name)
+		}
+		if r.PerSecond {
+			return fmt.Errorf("rule %q latency cannot be a rate per second", r.Name)
+		}
+	} else if r.Percentile != 0 {
+		return fmt.Errorf("rule %q percentile is only used by the latency metric", r.Name)
+	}
+	if r.MinRequests != 0 && r.Metric != MetricErrorRate && r.Metric != MetricLatency {
+		return fmt.Errorf("rule %q min_requests is only used by the error_rate and latency metrics", r.Name)
+	}
+	if r.MaxGroups < 0 {
+		return fmt.Errorf("rule %q max_groups must not be negative", r.Name)
+	}
+	if r.MinRequests < 0 {
+		return fmt.Errorf("rule %q min_requests must not be negative", r.Name)
+	}
+	if r.Window <= 0 {
+		return fmt.Errorf("rule %q window must be a positive number of seconds", r.Name)
+	}
+	if r.HalfLife < 0 {
+		return fmt.Errorf("rule %q half_life must not be negative", r.Name)
+	}
+	if r.Warmup < 0 {
+		return fmt.Errorf("rule %q warmup must not be negative", r.Name)
+	}
+	if r.For < 0 || r.RecoverFor < 0 || r.FlapLimit < 0 || r.FlapWindow < 0 {
+		return fmt.Errorf("rule %q for, recover_for, flap_limit and flap_window must not be negative", r.Name)
+	}
+	if r.below() && len(r.Baseline) == 0 {
+		if r.recoverThreshold() < r.Threshold {
+			return fmt.Errorf("rule %q recover_threshold must not be below the threshold", r.Name)
+		}
+		if r.Critical != 0 && r.Critical > r.Threshold {
+			return fmt.Errorf("rule %q critical threshold must not be above the threshold", r.Name)
+		}
+	} else {
+		if r.recoverThreshold() > r.Threshold {
+			return fmt.Errorf("rule %q recover_threshold must not be above the threshold", r.Name)
+		}
+		if r.Critical != 0 && r.Critical < r.Threshold {
+			return fmt.Errorf("rule %q critical threshold must not be below the threshold", r.Name)
+		}
+	}
+	if r.Critical != 0 && r.Severity != SeverityWarning {
+		return fmt.Errorf("rule %q critical threshold is only used by a warning rule", r.Name)
+	}
+	if len(r.Baseline) > 0 {
+		if _, err := r.newBaseline(); err != nil {
+			return fmt.Errorf("rule %q %v", r.Name, err)
+		}
+		if r.Threshold <= 0 {
+			return fmt.Errorf("rule %q threshold must be a positive number of standard deviations", r.Name)
+		}
+		if r.PerSecond {
+			return fmt.Errorf("rule %q baseline cannot be a rate per second", r.Name)
+		}
+	} else if r.Op == "<>" || r.HalfLife != 0 {
+		return fmt.Errorf("rule %q op <> and half_life are only used with a baseline", r.Name)
+	}
+	if _, err := compare(r.Op, 0, 0); err != nil && r.Op != "<>" {
+		return fmt.Errorf("rule %q %v", r.Name, err)
+	}
+	for attribute := range r.Filter {
+		if !isAttribute(attribute) {
+			return fmt.Errorf("rule %q filter has unknown attribute %q", r.Name, attribute)
+		}
+	}
+	if len(r.GroupBy) > 0 && !isAttribute(r.GroupBy) {
+		return fmt.Errorf("rule %q group has unknown attribute %q", r.Name, r.GroupBy)
+	}
+	return nil
+}
+
+// describe returns the description of the rule used in alert messages.
+func (r Rule) describe() string {
+	if len(r.Description) > 0 {
+		return r.Description
+	}
+	return r.Name
+}
+
+// maxGroups returns the maximum number of groups monitored at once.
+func (r Rule) maxGroups() int {
+	if r.MaxGroups > 0 {
+		return r.MaxGroups
+	}
+	return defaultMaxGroups
+}
+
+// statusClass returns the status class counted as an error by an error rate rule.
+func (r Rule) statusClass() string {
+	if len(r.Status) > 0 {
+		return r.Status
+	}
+	return defaultErrorStatus
+}
+
+// percentile returns the percentile of latency compared by a latency rule.
+func (r Rule) percentile() float64 {
+	if r.Percentile > 0 {
+		return r.Percentile
+	}
+	return defaultPercentile
+}
+
+// newBaseline returns a new baseline for the rule, or nil if the rule has a fixed threshold.
+func (r Rule) newBaseline() (*Baseline, error) {
+	if len(r.Baseline) == 0 {
+		return nil, nil
+	}
+	halfLife := r.HalfLife
+	if halfLife == 0 {
+		halfLife = defaultHalfLife
+	}
+	return NewBaseline(r.Baseline, halfLife)
+}
+
+// below reports whether the rule alerts when its total falls below a floor.
+func (r Rule) below() bool {
+	return r.Op == "<" || r.Op == "<="
+}
+
+// warmup returns the number of seconds after the monitor starts before the rule fires. A rule
+// which alerts below a floor waits for its window by default.
+func (r Rule) warmup() int {
+	if r.Warmup > 0 || !r.below() {
+		return r.Warmup
+	}
+	return r.Window
+}
+
+// recoverThreshold returns the threshold the total must pass back over to recover.
+func (r Rule) recoverThreshold() float64 {
+	if r.Recover != 0 {
+		return r.Recover
+	}
+	return r.Threshold
+}
+
+// flapWindow returns the number of seconds over which changes of state are counted.
+func (r Rule) flapWindow() int {
+	if r.FlapWindow > 0 {
+		return r.FlapWindow
+	}
+	return defaultFlapWindow
+}
+
+// limit returns the threshold for the total over the window.
+func (r Rule) limit() float64 {
+	return r.scale(r.Threshold)
+}
+
+// recoverLimit returns the recover threshold for the total over the window.
+func (r Rule) recoverLimit() float64 {
+	return r.scale(r.recoverThreshold())
+}
+
+// scale returns a threshold for the total over the window, from a threshold which may be an
+// average per second.
+func (r Rule) scale(threshold float64) float64 {
+	if r.PerSecond {
+		return threshold * float64(r.Window)
+	}
+	return threshold
+}
+
+// matches reports whether a line passes the rule's filter. A latency rule only matches lines
+// with a request time.
+func (r Rule) matches(line LogModel) bool {
+	if r.Metric == MetricLatency && !line.timed {
+		return false
+	}
+	for attribute, pattern := range r.Filter {
+		value, _ := line.Attribute(attribute)
+		if !matchAttribute(attribute, pattern, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// measure returns the amount a line contributes to the rule's metric. For an error rate this
+// is 1 if the line is an error. A latency rule's request times are kept in a sketch instead.
+func (r Rule) measure(line LogModel) float64 {
+	switch r.Metric {
+	case MetricBytes:
+		return float64(line.bytes)
+	case MetricErrorRate:
+		if status, _ := line.Attribute("status"); !matchAttribute("status", r.statusClass(), status) {
+			return 0
+		}
+	}
+	return 1
+}
+
+// evaluate returns the value of the rule's metric for a window total and whether the window
+// has enough requests for the value to be compared. An error rate or latency rule is not
+// compared until the window has the minimum number of requests, and a latency rule is not
+// compared for a window without requests.
+func (r Rule) evaluate(total sample) (float64, bool) {
+	value := total.value
+	switch r.Metric {
+	case MetricErrorRate:
+		if total.requests == 0 {
+			value = 0
+		} else {
+			value = 100 * total.value / total.requests
+		}
+		if total.requests < float64(r.MinRequests) {
+			return value, false
+		}
+	case MetricLatency:
+		if total.latency == nil || total.latency.Count() == 0 {
+			return 0, false
+		}
+		value = total.latency.Quantile(r.percentile() / 100)
+		if total.requests < float64(r.MinRequests) {
+			return value, false
+		}
+	}
+	return value, true
+}
+
+// deviates reports whether a value deviates from a baseline's mean by at least sigma standard
+// deviations, in the direction of the rule's comparison, and returns the bound which is compared
+// against.
+func (r Rule) deviates(value float64, mean float64, stddev float64, sigma float64) (bool, float64) {
+	upper := mean + sigma*stddev
+	lower := mean - sigma*stddev
+	switch r.Op {
+	case ">=", ">":
+		firing, _ := compare(r.Op, value, upper)
+		return firing, upper
+	case "<=", "<":
+		firing, _ := compare(r.Op, value, lower)
+		return firing, lower
+	default:
+		if value >= mean {
+			return value >= upper, upper
+		}
+		return value <= lower, lower
+	}
+}
+
+// isStatusClass reports whether a pattern matches a class of status, such as 5xx.
+func isStatusClass(pattern string) bool {
+	return len(pattern) == 3 && pattern[0] >= '1' && pattern[0] <= '5' && strings.HasSuffix(pattern, "xx")
+}
+
+// matchAttribute reports whether an attribute value matches a filter pattern. Patterns are
+// matched exactly, except that a status may be matched by its class, such as 5xx.
+func matchAttribute(attribute string, pattern string, value string) bool {
+	if attribute == "status" && isStatusClass(pattern) {
+		return len(value) == 3 && value[0] == pattern[0]
+	}
+	return pattern == value
+}
+
+// compare applies the comparison op to a value and threshold.
+func compare(op string, value float64, threshold float64) (bool, error) {
+	switch op {
+	case ">=":
+		return value >= threshold, nil
+	case ">":
+		return value > threshold, nil
+	case "<=":
+		return value <= threshold, nil
+	case "<":
+		return value < threshold, nil
+	default:
+		return false, fmt.Errorf("unknown comparison %q, want >=, >, <= or <", op)
+	}
+}
+
+// ParseRule parses a rule from comma separated key=value pairs. Filters are given as
+// semicolon separated attribute:value pairs.
+func ParseRule(spec string) (Rule, error) {
+	rule := defaultRule()
+	for _, pair := range strings.Split(spec, ",") {
+		split := strings.SplitN(pair, "=", 2)
+		if len(split) != 2 {
+			return Rule{}, fmt.Errorf("invalid rule setting %q, want key=value", pair)
+		}
+		key, value := split[0], split[1]
+
+		var err error
+		switch key {
+		case "name":
+			rule.Name = value
+		case "description":
+			rule.Description = value
+		case "metric":
+			rule.Metric = value
+		case "filter":
+			rule.Filter = make(map[string]string)
+			for _, filter := range strings.Split(value, ";") {
+				split := strings.SplitN(filter, ":", 2)
+				if len(split) != 2 {
+					return Rule{}, fmt.Errorf("invalid rule filter %q, want attribute:value", filter)
+				}
+				rule.Filter[split[0]] = split[1]
+			}
+		case "group":
+			rule.GroupBy = value
+		case "window":
+			rule.Window, err = strconv.Atoi(value)
+		case "op":
+			rule.Op = value
+		case "threshold":
+			rule.Threshold, err = strconv.ParseFloat(value, 64)
+		case "rate":
+			rule.PerSecond, err = strconv.ParseBool(value)
+		case "severity":
+			rule.Severity, err = ParseSeverity(value)
+		case "critical":
+			rule.Critical, err = strconv.ParseFloat(value, 64)
+		case "status":
+			rule.Status = value
+		case "min_requests":
+			rule.MinRequests, err = strconv.Atoi(value)
+		case "max_groups":
+			rule.MaxGroups, err = strconv.Atoi(value)
+		case "percentile":
+			rule.Percentile, err = strconv.ParseFloat(value, 64)
+		case "baseline":
+			rule.Baseline = value
+		case "half_life":
+			rule.HalfLife, err = strconv.Atoi(value)
+		case "warmup":
+			rule.Warmup, err = strconv.Atoi(value)
+		case "recover_threshold":
+			rule.Recover, err = strconv.ParseFloat(value, 64)
+		case "for":
+			rule.For, err = strconv.Atoi(value)
+		case "recover_for":
+			rule.RecoverFor, err = strconv.Atoi(value)
+		case "flap_limit":
+			rule.FlapLimit, err = strconv.Atoi(value)
+		case "flap_window":
+			rule.FlapWindow, err = strconv.Atoi(value)
+		default:
+			return Rule{}, fmt.Errorf("unknown rule setting %q", key)
+		}
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid rule %s %q: %v", key, value, err)
+		}
+	}
+	return rule, rule.Validate()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRule(t *testing.T) {
+	var tests = []struct {
+		input string
+		want  Rule
+		fail  bool
+	}{
+		{"name=api_errors,filter=status:5xx;section:/api,group=remotehost,window=60,op=>,threshold=10,severity=critical",
+			Rule{Name: "api_errors", Metric: MetricHits, Filter: map[string]string{"status": "5xx", "section": "/api"},
+				GroupBy: "remotehost", Window: 60, Op: ">", Threshold: 10, Severity: SeverityCritical}, false},
+		{"name=bandwidth,description=High bandwidth,metric=bytes,window=10,threshold=1000000,rate=true",
+			Rule{Name: "bandwidth", Description: "High bandwidth", Metric: MetricBytes, Window: 10, Op: ">=",
+				Threshold: 1000000, PerSecond: true, Severity: SeverityWarning}, false},
+		{"name=errors,metric=error_rate,status=4xx,min_requests=50,window=60,threshold=5",
+			Rule{Name: "errors", Metric: MetricErrorRate, Window: 60, Op: ">=", Threshold: 5, Severity: SeverityWarning,
+				Status: "4xx", MinRequests: 50}, false},
+		{"name=sections,group=section,window=10,threshold=5,max_groups=100",
+			Rule{Name: "sections", Metric: MetricHits, GroupBy: "section", Window: 10, Op: ">=", Threshold: 5,
+				Severity: SeverityWarning, MaxGroups: 100}, false},
+		{"name=slow,metric=latency,percentile=90,group=section,window=60,threshold=0.5",
+			Rule{Name: "slow", Metric: MetricLatency, GroupBy: "section", Window: 60, Op: ">=", Threshold: 0.5,
+				Severity: SeverityWarning, Percentile: 90}, false},
+		{"name=anomaly,baseline=daily,half_life=600,op=<>,window=60,threshold=3",
+			Rule{Name: "anomaly", Metric: MetricHits, Window: 60, Op: "<>", Threshold: 3, Severity: SeverityWarning,
+				Baseline: BaselineDaily, HalfLife: 600}, false},
+		{"name=quiet,op=<,threshold=5,window=60,warmup=300",
+			Rule{Name: "quiet", Metric: MetricHits, Window: 60, Op: "<", Threshold: 5, Severity: SeverityWarning,
+				Warmup: 300}, false},
+		{"name=busy,window=60,threshold=100,recover_threshold=80,for=30,recover_for=60,flap_limit=4,flap_window=900",
+			Rule{Name: "busy", Metric: MetricHits, Window: 60, Op: ">=", Threshold: 100, Severity: SeverityWarning,
+				Recover: 80, For: 30, RecoverFor: 60, FlapLimit: 4, FlapWindow: 900}, false},
+		{"name=traffic,window=10,threshold=10,critical=25",
+			Rule{Name: "traffic", Metric: MetricHits, Window: 10, Op: ">=", Threshold: 10, Severity: SeverityWarning,
+				Critical: 25}, false},
+		{"name=a,window=10,max_groups=-1", Rule{}, true},
+		{"name=a,window=10,threshold=10,critical=5", Rule{}, true},
+		{"name=a,window=10,op=<,threshold=5,critical=10", Rule{}, true},
+		{"name=a,window=10,threshold=10,critical=25,severity=critical", Rule{}, true},
+		{"name=a,window=10,threshold=5,recover_threshold=6", Rule{}, true},
+		{"name=a,window=10,op=<,threshold=5,recover_threshold=4", Rule{}, true},
+		{"name=a,window=10,for=-1", Rule{}, true},
+		{"name=a,window=10,warmup=-1", Rule{}, true},
+		{"name=a,window=10,op=<>,threshold=3", Rule{}, true},
+		{"name=a,window=10,half_life=60", Rule{}, true},
+		{"name=a,window=10,baseline=weekly,threshold=3", Rule{}, true},
+		{"name=a,window=10,baseline=ewma", Rule{}, true},
+		{"name=a,window=10,baseline=ewma,threshold=3,rate=true", Rule{}, true},
+		{"name=a,window=10,metric=error_rate,status=500", Rule{}, true},
+		{"name=a,window=10,metric=error_rate,threshold=101", Rule{}, true},
+		{"name=a,window=10,metric=error_rate,rate=true", Rule{}, true},
+		{"name=a,window=10,status=5xx", Rule{}, true},
+		{"name=a,window=10,metric=error_rate,min_requests=-1", Rule{}, true},
+		{"window=10", Rule{}, true},
+		{"name=a,window=0", Rule{}, true},
+		{"name=a,window=10,metric=duration", Rule{}, true},
+		{"name=a,window=10,metric=latency,percentile=101", Rule{}, true},
+		{"name=a,window=10,metric=latency,rate=true", Rule{}, true},
+		{"name=a,window=10,percentile=99", Rule{}, true},
+		{"name=a,window=10,min_requests=10", Rule{}, true},
+		{"name=a,window=10,op==", Rule{}, true},
+		{"name=a,window=10,filter=colour:red", Rule{}, true},
+		{"name=a,window=10,filter=status", Rule{}, true},
+		{"name=a,window=10,group=colour", Rule{}, true},
+		{"name=a,window=ten", Rule{}, true},
+		{"name=a,window=10,severity=fatal", Rule{}, true},
+		{"name=a,window=10,size=large", Rule{}, true},
+		{"name", Rule{}, true},
+	}
+	for _, test := range tests {
+		got, err := ParseRule(test.input)
+		if test.fail {
+			if err == nil {
+				t.Errorf(`ParseRule(%q) returned no error`, test.input)
+			}
+		} else if err != nil || !cmp.Equal(got, test.want) {
+			t.Errorf(`ParseRule(%q) returned %+v, %v, want %+v`, test.input, got, err, test.want)
+		}
+	}
+}
+
+func TestMatchAttribute(t *testing.T) {
+	var tests = []struct {
+		attribute string
+		pattern   string
+		value     string
+		want      bool
+	}{
+		{"status", "5xx", "503", true},
+		{"status", "5xx", "404", false},
+		{"status", "404", "404", true},
+		{"section", "/api", "/api", true},
+		{"section", "/xxx", "/api", false},
+		{"method", "Gxx", "GET", false},
+	}
+	for _, test := range tests {
+		if got := matchAttribute(test.attribute, test.pattern, test.value); got != test.want {
+			t.Errorf(`matchAttribute(%q, %q, %q) returned %v, want %v`, test.attribute, test.pattern, test.value, got, test.want)
+		}
+	}
+}
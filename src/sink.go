@@ -0,0 +1,332 @@
+/*
+A `Sink` is an output for the stats reports and alerts of a `Player`, such as the console or a
+file. The `Player` fans each event out to every sink it has been given. Each sink is wrapped in
+a buffer with a goroutine of its own, so a slow sink, such as one writing to a full disk, does
+not stall the `Player` or the other sinks. The buffer holds stats reports and alerts in order,
+but bounds each separately, so a backlog of stats reports cannot crowd out alerts. If a sink
+falls so far behind that its buffer fills, further events are dropped for that sink alone and
+counted, rather than holding back time. The first drop of each kind is reported as it happens.
+A sink which only delivers alerts, such as a webhook, marks itself `AlertsOnly` so that no stats
+reports are buffered for it. Closing the `Player`'s sinks waits for each buffer to be written.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+
+	defaultSinkBuffer = 1024
+)
+
+// Sink receives the stats reports and alerts of a Player.
+type Sink interface {
+	Stats(report StatsReport) error
+	Alert(alert Alert) error
+	Close() error
+}
+
+// AlertsOnly is implemented by a Sink which ignores stats reports, so none need be sent to it.
+type AlertsOnly interface {
+	AlertsOnly()
+}
+
+// TextSink writes stats reports and alerts as lines of text, coloured when written to a
+// terminal.
+type TextSink struct {
+	out    io.Writer
+	colour bool // colour lines with ANSI escape codes
+	closer io.Closer
+}
+
+// NewConsoleSink returns a Sink which writes to stdout in the given format, text or json.
+// Text is coloured only if stdout is a terminal.
+func NewConsoleSink(format string) Sink {
+	return newFormatSink(format, os.Stdout, nil)
+}
+
+// NewFileSink returns a Sink which appends to the file at path in the given format, text or
+// json.
+func NewFileSink(path string, format string) (Sink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open output file: %v", err)
+	}
+	return newFormatSink(format, file, file), nil
+}
+
+// newFormatSink returns a Sink which writes to a file in the given format, closing it with
+// closer.
+func newFormatSink(format string, out *os.File, closer io.Closer) Sink {
+	if format == OutputJSON {
+		return &JSONSink{encoder: json.NewEncoder(out), closer: closer}
+	}
+	return &TextSink{out: out, colour: isTerminal(out), closer: closer}
+}
+
+// Stats writes the top sections, the top values of each ranking and the latency of a report.
+func (s *TextSink) Stats(report StatsReport) error {
+	s.setColour(ColourYellow)
+	fmt.Fprintf(s.out, "[STATS]\t%v\t%s", report.tick, sourceLabel(report.source))
+	for _, got := range report.sections {
+		fmt.Fprintf(s.out, "%s: %s (%s) ", got.key, formatHits(got), formatBytes(got.bytes))
+	}
+	fmt.Fprintf(s.out, "total: %s", formatBytes(report.bytes))
+	fmt.Fprint(s.out, "\n")
+	for _, ranking := range report.rankings {
+		if len(ranking.results) == 0 {
+			continue
+		}
+		fmt.Fprintf(s.out, "[STATS]\t%v\t%s%s: ", report.tick, sourceLabel(report.source), ranking.name)
+		for _, got := range ranking.results {
+			fmt.Fprintf(s.out, "%s: %s ", got.key, formatHits(got))
+		}
+		fmt.Fprint(s.out, "\n")
+	}
+	if report.latency.count > 0 {
+		fmt.Fprintf(s.out, "[STATS]\t%v\t%slatency: ", report.tick, sourceLabel(report.source))
+		for _, got := range report.sectionLatencies {
+			fmt.Fprintf(s.out, "%s: %s ", got.key, formatPercentiles(got))
+		}
+		fmt.Fprintf(s.out, "total: %s\n", formatPercentiles(report.latency))
+	}
+	return s.setColour(ColourReset)
+}
+
+// Alert writes a message based on the alert's state, coloured by its severity.
+func (s *TextSink) Alert(alert Alert) error {
+	subject := alert.description
+	if len(alert.key) > 0 {
+		subject = fmt.Sprintf("%s for %s", subject, alert.key)
+	}
+	switch {
+	case alert.state == AlertFiring && alert.escalated:
+		change := "escalated to"
+		if alert.severity == SeverityWarning {
+			change = "returned to"
+		}
+		s.setColour(alert.severity.Colour())
+		fmt.Fprintf(s.out, "[ALERT]\t%v\t%s%s alert %s %s - %s\n", alert.time, sourceLabel(alert.source), subject, change, alert.severity, formatAlertValue(alert))
+	case alert.state == AlertFiring:
+		s.setColour(alert.severity.Colour())
+		fmt.Fprintf(s.out, "[ALERT]\t%v\t%s%s generated a %s alert - %s\n", alert.time, sourceLabel(alert.source), subject, alert.severity, formatAlertValue(alert))
+	case alert.state == AlertNone:
+		s.setColour(ColourGreen)
+		fmt.Fprintf(s.out, "[ALERT]\t%v\t%s%s alert recovered\n", alert.time, sourceLabel(alert.source), subject)
+	case alert.state == AlertFlapping:
+		s.setColour(ColourYellow)
+		fmt.Fprintf(s.out, "[ALERT]\t%v\t%s%s alert is flapping, alerts are suppressed until it settles\n", alert.time, sourceLabel(alert.source), subject)
+	default:
+		return fmt.Errorf("unknown alert state: %v rule: %v time: %v", alert.state, alert.rule, alert.time)
+	}
+	return s.setColour(ColourReset)
+}
+
+// setColour writes an ANSI colour code if the sink is coloured.
+func (s *TextSink) setColour(colour Colour) error {
+	if !s.colour {
+		return nil
+	}
+	_, err := fmt.Fprint(s.out, colour)
+	return err
+}
+
+// Close closes the file written to, if any.
+func (s *TextSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// formatHits formats the hits of a result, as the range of the true number of hits if the
+// count is approximate.
+func formatHits(result TopKResult) string {
+	if result.error > 0 {
+		return fmt.Sprintf("%v..%v", result.hits-result.error, result.hits)
+	}
+	return fmt.Sprint(result.hits)
+}
+
+// formatAlertValue formats the value of an alert's metric, and the value expected by its
+// baseline if it has one.
+func formatAlertValue(alert Alert) string {
+	value := fmt.Sprintf("%s = %s", alert.metric, formatMetric(alert.metric, alert.value))
+	if len(alert.baseline) > 0 {
+		value += fmt.Sprintf(", expected %s", formatMetric(alert.metric, alert.expected))
+	}
+	return value
+}
+
+// event is a stats report or an alert waiting in a sink's buffer.
+type event struct {
+	report *StatsReport
+	alert  *Alert
+}
+
+// bufferedSink passes events to a sink from a goroutine of its own. Neither Stats nor Alert
+// blocks: an event is dropped if the buffer holds its limit of events of that kind.
+type bufferedSink struct {
+	sink          Sink
+	alertsOnly    bool // the sink ignores stats reports, so they are not buffered
+	size          int  // maximum number of stats reports, and of alerts, held
+	mu            sync.Mutex
+	ready         *sync.Cond // signalled when an event is buffered or the buffer is closed
+	events        []event    // events waiting to be written, oldest first
+	reports       int        // stats reports in events
+	alerts        int        // alerts in events
+	closed        bool
+	dropped       int       // stats reports dropped as the buffer was full
+	droppedAlerts int       // alerts dropped as the buffer was full
+	report        io.Writer // destination for reports of dropped events
+	done          sync.WaitGroup
+}
+
+// newBufferedSink returns a sink which buffers up to size stats reports and size alerts for
+// another sink.
+func newBufferedSink(sink Sink, size int) *bufferedSink {
+	_, alertsOnly := sink.(AlertsOnly)
+	b := &bufferedSink{sink: sink, alertsOnly: alertsOnly, size: size, report: os.Stderr}
+	b.ready = sync.NewCond(&b.mu)
+	b.done.Add(1)
+	go b.run()
+	return b
+}
+
+// run passes events to the sink until the buffer is closed and empty.
+func (b *bufferedSink) run() {
+	defer b.done.Done()
+	for {
+		b.mu.Lock()
+		for len(b.events) == 0 && !b.closed {
+			b.ready.Wait()
+		}
+		if len(b.events) == 0 {
+			b.mu.Unlock()
+			return
+		}
+		e := b.events[0]
+		b.events = b.events[1:]
+		if e.report != nil {
+			b.reports--
+		} else {
+			b.alerts--
+		}
+		b.mu.Unlock()
+
+		var err error
+		if e.report != nil {
+			err = b.sink.Stats(*e.report)
+		} else {
+			err = b.sink.Alert(*e.alert)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write output: %v\n", err)
+		}
+	}
+}
+
+// Stats buffers a stats report, or drops it if the buffer is full of stats reports or the sink
+// only takes alerts.
+func (b *bufferedSink) Stats(report StatsReport) error {
+	if b.alertsOnly {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.reports >= b.size {
+		b.dropped++
+		if b.dropped == 1 {
+			fmt.Fprintf(b.report, "Stats report at %v dropped as an output fell behind, further drops are counted.\n", report.tick)
+		}
+		return nil
+	}
+	b.events = append(b.events, event{report: &report})
+	b.reports++
+	b.ready.Signal()
+	return nil
+}
+
+// Alert buffers an alert, or drops it if the buffer is full of alerts.
+func (b *bufferedSink) Alert(alert Alert) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.alerts >= b.size {
+		b.droppedAlerts++
+		if b.droppedAlerts == 1 {
+			fmt.Fprintf(b.report, "Alert at %v dropped as an output fell behind, further drops are counted.\n", alert.time)
+		}
+		return nil
+	}
+	b.events = append(b.events, event{alert: &alert})
+	b.alerts++
+	b.ready.Signal()
+	return nil
+}
+
+// Close waits for the buffered events to be written and closes the sink.
+func (b *bufferedSink) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.ready.Signal()
+	b.mu.Unlock()
+	b.done.Wait()
+	if b.dropped > 0 {
+		fmt.Fprintf(b.report, "%v stats reports dropped as an output fell behind.\n", b.dropped)
+	}
+	if b.droppedAlerts > 0 {
+		fmt.Fprintf(b.report, "%v alerts dropped as an output fell behind.\n", b.droppedAlerts)
+	}
+	return b.sink.Close()
+}
+
+// Fanout is a Sink which passes each event to every one of a list of sinks.
+type Fanout struct {
+	sinks []Sink
+}
+
+// Add adds a sink to receive events.
+func (f *Fanout) Add(sink Sink) {
+	f.sinks = append(f.sinks, sink)
+}
+
+// Stats passes a stats report to every sink, returning the first error.
+func (f *Fanout) Stats(report StatsReport) error {
+	var first error
+	for _, sink := range f.sinks {
+		if err := sink.Stats(report); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Alert passes an alert to every sink, returning the first error.
+func (f *Fanout) Alert(alert Alert) error {
+	var first error
+	for _, sink := range f.sinks {
+		if err := sink.Alert(alert); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Close closes every sink, returning the first error.
+func (f *Fanout) Close() error {
+	var first error
+	for _, sink := range f.sinks {
+		if err := sink.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	f.sinks = nil
+	return first
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// funcSink is a Sink which passes stats reports and alerts to functions, either of which may
+// be nil to ignore them.
+type funcSink struct {
+	stats func(StatsReport)
+	alert func(Alert)
+}
+
+func (s funcSink) Stats(report StatsReport) error {
+	if s.stats != nil {
+		s.stats(report)
+	}
+	return nil
+}
+
+func (s funcSink) Alert(alert Alert) error {
+	if s.alert != nil {
+		s.alert(alert)
+	}
+	return nil
+}
+
+func (s funcSink) Close() error {
+	return nil
+}
+
+func TestTextSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := &TextSink{out: &out}
+
+	sink.Stats(StatsReport{
+		source:   "web1",
+		tick:     10,
+		sections: []TopKResult{{"/api", 3, 2048, 0}, {"/report", 2, 0, 1}},
+		bytes:    2048,
+		rankings: []Ranking{{"hosts", []TopKResult{{"10.0.0.1", 3, 0, 1}}}, {"users", nil}},
+	})
+	sink.Alert(Alert{description: "High traffic", state: AlertFiring, severity: SeverityCritical, metric: MetricHits, value: 12, time: 11})
+	sink.Alert(Alert{description: "High traffic", state: AlertFiring, severity: SeverityWarning, escalated: true, metric: MetricHits, value: 8, time: 12})
+	sink.Alert(Alert{description: "Section traffic", key: "/api", state: AlertNone, time: 13})
+	if err := sink.Alert(Alert{state: AlertState(9)}); err == nil {
+		t.Errorf(`TextSink.Alert with an unknown state returned no error`)
+	}
+
+	want := "[STATS]\t10\t[web1] /api: 3 (2.0 KB) /report: 1..2 (0 B) total: 2.0 KB\n" +
+		"[STATS]\t10\t[web1] hosts: 10.0.0.1: 2..3 \n" +
+		"[ALERT]\t11\tHigh traffic generated a critical alert - hits = 12\n" +
+		"[ALERT]\t12\tHigh traffic alert returned to warning - hits = 8\n" +
+		"[ALERT]\t13\tSection traffic for /api alert recovered\n"
+	if got := out.String(); got != want {
+		t.Errorf(`TextSink wrote %q, want %q`, got, want)
+	}
+
+	out.Reset()
+	sink.colour = true
+	sink.Alert(Alert{description: "High traffic", state: AlertNone, time: 13})
+	want = fmt.Sprintf("%s[ALERT]\t13\tHigh traffic alert recovered\n%s", ColourGreen, ColourReset)
+	if got := out.String(); got != want {
+		t.Errorf(`Coloured TextSink wrote %q, want %q`, got, want)
+	}
+}
+
+func TestBufferedSink(t *testing.T) {
+	// The sink is blocked until released, so later events overflow the buffer.
+	received, release := make(chan bool, 5), make(chan bool)
+	var got []string
+	sink := newBufferedSink(funcSink{
+		stats: func(report StatsReport) { got = append(got, fmt.Sprint("stats ", report.tick)) },
+		alert: func(a Alert) {
+			received <- true
+			<-release
+			got = append(got, fmt.Sprint("alert ", a.time))
+		},
+	}, 2)
+	var report bytes.Buffer
+	sink.report = &report
+
+	// The first alert is taken from the buffer by the blocked sink, leaving room for two more.
+	sink.Alert(Alert{time: 1})
+	<-received
+	for tick := int64(2); tick <= 5; tick++ {
+		sink.Stats(StatsReport{tick: tick})
+	}
+	if want := "Stats report at 4 dropped"; !strings.HasPrefix(report.String(), want) {
+		t.Errorf(`Buffered sink reported %q when full, want %q`, report.String(), want)
+	}
+
+	// Alerts have room of their own, so are not crowded out by the stats reports, but an alert
+	// is dropped rather than waiting once that is full.
+	for tick := int64(6); tick <= 8; tick++ {
+		sink.Alert(Alert{time: tick})
+	}
+	if want := "Alert at 8 dropped"; !strings.Contains(report.String(), want) {
+		t.Errorf(`Buffered sink reported %q when full of alerts, want %q`, report.String(), want)
+	}
+	close(release)
+	sink.Close()
+
+	want := []string{"alert 1", "stats 2", "stats 3", "alert 6", "alert 7"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf(`Buffered sink wrote %v, want %v`, got, want)
+	}
+	if sink.dropped != 2 || sink.droppedAlerts != 1 || strings.Count(report.String(), "dropped") != 4 {
+		t.Errorf(`Buffered sink dropped %v stats reports and %v alerts and reported %q, want 2, 1 and four reports`,
+			sink.dropped, sink.droppedAlerts, report.String())
+	}
+}
+
+// alertSink is a funcSink which only takes alerts.
+type alertSink struct {
+	funcSink
+}
+
+func (s alertSink) AlertsOnly() {}
+
+func TestBufferedSinkAlertsOnly(t *testing.T) {
+	var got []string
+	sink := newBufferedSink(alertSink{funcSink{
+		stats: func(report StatsReport) { got = append(got, fmt.Sprint("stats ", report.tick)) },
+		alert: func(a Alert) { got = append(got, fmt.Sprint("alert ", a.time)) },
+	}}, 1)
+
+	// Stats reports are neither buffered nor counted as dropped, so cannot hold up an alert.
+	for tick := int64(1); tick <= 3; tick++ {
+		sink.Stats(StatsReport{tick: tick})
+	}
+	sink.Alert(Alert{time: 4})
+	sink.Close()
+
+	if fmt.Sprint(got) != "[alert 4]" || sink.dropped != 0 {
+		t.Errorf(`Buffered alert-only sink wrote %v and dropped %v, want [alert 4] and 0`, got, sink.dropped)
+	}
+}
+
+func TestFanout(t *testing.T) {
+	var first, second []string
+	fanout := &Fanout{}
+	fanout.Add(funcSink{alert: func(a Alert) { first = append(first, a.rule) }})
+	fanout.Add(funcSink{
+		stats: func(report StatsReport) { second = append(second, "stats") },
+		alert: func(a Alert) { second = append(second, a.rule) },
+	})
+
+	fanout.Alert(Alert{rule: "a"})
+	fanout.Stats(StatsReport{})
+	fanout.Alert(Alert{rule: "b"})
+
+	if fmt.Sprint(first) != "[a b]" || fmt.Sprint(second) != "[a stats b]" {
+		t.Errorf(`Fanout sent %v and %v, want [a b] and [a stats b]`, first, second)
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewJSONSink(&out)
+
+	sink.Stats(StatsReport{
+		tick:     10,
+		sections: []TopKResult{{"/api", 3, 2048, 0}},
+		bytes:    2048,
+		rankings: []Ranking{{"hosts", []TopKResult{{"10.0.0.1", 3, 2048, 1}}}, {"users", nil}},
+		latency:  LatencyResult{count: 3, p50: 0.1, p90: 0.2, p99: 0.3, max: 0.3},
+	})
+	sink.Alert(Alert{rule: "high_traffic", description: "High traffic", source: "web1", state: AlertFiring,
+		severity: SeverityCritical, metric: MetricHits, value: 12, hits: 12, threshold: 10, window: 5, time: 11})
+	sink.Alert(Alert{rule: "anomaly", description: "Traffic anomaly", state: AlertNone, severity: SeverityWarning,
+		metric: MetricHits, value: 5, hits: 5, threshold: 8, window: 5, time: 12, baseline: BaselineEWMA, expected: 20})
+
+	want := `{"type":"stats","timestamp":10,"sections":[{"key":"/api","hits":3,"bytes":2048}],"bytes":2048,` +
+		`"rankings":[{"name":"hosts","results":[{"key":"10.0.0.1","hits":3,"bytes":2048,"error":1}]},{"name":"users","results":[]}],` +
+		`"latency":{"count":3,"p50":0.1,"p90":0.2,"p99":0.3,"max":0.3}}` + "\n" +
+		`{"type":"alert","timestamp":11,"rule":"high_traffic","description":"High traffic","source":"web1","state":"firing",` +
+		`"severity":"critical","metric":"hits","value":12,"hits":12,"threshold":10,"window":5}` + "\n" +
+		`{"type":"alert","timestamp":12,"rule":"anomaly","description":"Traffic anomaly","state":"recovered",` +
+		`"severity":"warning","metric":"hits","value":5,"hits":5,"threshold":8,"window":5,"expected":20}` + "\n"
+	if got := out.String(); got != want {
+		t.Errorf(`JSONSink wrote %s, want %s`, got, want)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.log")
+	sink, err := NewFileSink(path, OutputText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file is not a terminal, so the text is not coloured.
+	sink.Alert(Alert{description: "High traffic", state: AlertNone, time: 13})
+	sink.Close()
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[ALERT]\t13\tHigh traffic alert recovered\n"; string(got) != want {
+		t.Errorf(`File sink wrote %q, want %q`, got, want)
+	}
+}
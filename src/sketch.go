@@ -0,0 +1,140 @@
+/*
+`LatencySketch` summarises request latencies so that percentiles can be reported without keeping
+every value. In the manner of DDSketch, latencies are counted in buckets whose bounds grow by a
+fixed ratio, so that any quantile is found with a relative error of at most 1% using a number of
+buckets which grows only with the logarithm of the range of latencies. As a sketch is a map of
+bucket counts, two sketches are merged, or one is subtracted from another, by adding or
+subtracting their counts. This allows the `Monitor` to keep a sketch for each second of a window
+and maintain the sketch for the whole window as seconds are pushed and popped.
+*/
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	sketchAccuracy   = 0.01 // maximum relative error of a quantile
+	sketchMinLatency = 1e-6 // latencies in seconds below this are counted as zero
+)
+
+var (
+	sketchGamma    = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+type LatencySketch struct {
+	buckets map[int]int // number of latencies in each bucket, by index
+	zeros   int         // number of latencies too small to bucket
+	count   int         // total number of latencies
+	max     float64     // largest latency added
+}
+
+// NewLatencySketch returns a new, empty LatencySketch.
+func NewLatencySketch() *LatencySketch {
+	return &LatencySketch{buckets: make(map[int]int)}
+}
+
+// Add records a latency in seconds.
+// This call takes O(1)
+func (s *LatencySketch) Add(latency float64) {
+	if latency < sketchMinLatency {
+		s.zeros++
+	} else {
+		s.buckets[bucketIndex(latency)]++
+	}
+	s.count++
+	if latency > s.max {
+		s.max = latency
+	}
+}
+
+// Merge adds the latencies recorded by another sketch.
+// This call takes O(b), for b buckets in the other sketch.
+func (s *LatencySketch) Merge(other *LatencySketch) {
+	for index, count := range other.buckets {
+		s.buckets[index] += count
+	}
+	s.zeros += other.zeros
+	s.count += other.count
+	if other.max > s.max {
+		s.max = other.max
+	}
+}
+
+// Subtract removes the latencies recorded by another sketch, which must have been merged into
+// this one. The maximum is not lowered, so it is an upper bound once latencies are removed.
+// This call takes O(b), for b buckets in the other sketch.
+func (s *LatencySketch) Subtract(other *LatencySketch) {
+	for index, count := range other.buckets {
+		if s.buckets[index] -= count; s.buckets[index] <= 0 {
+			delete(s.buckets, index)
+		}
+	}
+	s.zeros -= other.zeros
+	s.count -= other.count
+	if s.count == 0 {
+		s.max = 0
+	}
+}
+
+// Count returns the number of latencies recorded.
+func (s *LatencySketch) Count() int {
+	return s.count
+}
+
+// Max returns the largest latency recorded.
+func (s *LatencySketch) Max() float64 {
+	return s.max
+}
+
+// Quantile returns the latency below which the fraction q of latencies fall, such as 0.99 for
+// the 99th percentile, or 0 if no latencies have been recorded.
+// This call takes O(b log b), for b buckets.
+func (s *LatencySketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	// The nearest rank, counting from 0, of the latency at the quantile.
+	rank := int(math.Ceil(q*float64(s.count))) - 1
+	if rank < s.zeros {
+		return 0
+	}
+	indexes := make([]int, 0, len(s.buckets))
+	for index := range s.buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	seen := s.zeros
+	for _, index := range indexes {
+		seen += s.buckets[index]
+		if seen > rank {
+			return math.Min(bucketValue(index), s.max)
+		}
+	}
+	return s.max
+}
+
+// Clear removes every latency.
+func (s *LatencySketch) Clear() {
+	for index := range s.buckets {
+		delete(s.buckets, index)
+	}
+	s.zeros = 0
+	s.count = 0
+	s.max = 0
+}
+
+// bucketIndex returns the index of the bucket holding a latency, which holds latencies
+// between gamma^(index-1) and gamma^index.
+func bucketIndex(latency float64) int {
+	return int(math.Ceil(math.Log(latency) / sketchLogGamma))
+}
+
+// bucketValue returns the latency reported for a bucket, which is within the relative
+// accuracy of every latency in the bucket.
+func bucketValue(index int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(index)) / (sketchGamma + 1)
+}
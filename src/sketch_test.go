@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLatencySketch(t *testing.T) {
+	sketch := NewLatencySketch()
+	if got := sketch.Quantile(0.5); got != 0 {
+		t.Errorf(`Quantile(0.5) of an empty sketch returned %v, want 0`, got)
+	}
+
+	// Latencies of 1ms to 1000ms, and one request too quick to bucket.
+	sketch.Add(0)
+	for i := 1; i <= 1000; i++ {
+		sketch.Add(float64(i) / 1000)
+	}
+	var tests = []struct {
+		q    float64
+		want float64
+	}{
+		{0, 0},
+		{0.5, 0.5},
+		{0.9, 0.9},
+		{0.99, 0.99},
+		{1, 1},
+	}
+	for _, test := range tests {
+		got := sketch.Quantile(test.q)
+		if math.Abs(got-test.want) > sketchAccuracy*test.want {
+			t.Errorf(`Quantile(%v) returned %v, want %v within 1%%`, test.q, got, test.want)
+		}
+	}
+	if sketch.Count() != 1001 || sketch.Max() != 1 {
+		t.Errorf(`sketch has count %v and max %v, want 1001 and 1`, sketch.Count(), sketch.Max())
+	}
+}
+
+func TestLatencySketchMerge(t *testing.T) {
+	fast := NewLatencySketch()
+	slow := NewLatencySketch()
+	for i := 0; i < 90; i++ {
+		fast.Add(0.01)
+	}
+	for i := 0; i < 10; i++ {
+		slow.Add(2)
+	}
+
+	total := NewLatencySketch()
+	total.Merge(fast)
+	total.Merge(slow)
+	if got := total.Quantile(0.5); math.Abs(got-0.01) > sketchAccuracy*0.01 {
+		t.Errorf(`merged Quantile(0.5) returned %v, want 0.01`, got)
+	}
+	if got := total.Quantile(0.99); math.Abs(got-2) > sketchAccuracy*2 {
+		t.Errorf(`merged Quantile(0.99) returned %v, want 2`, got)
+	}
+
+	total.Subtract(slow)
+	if got := total.Quantile(0.99); math.Abs(got-0.01) > sketchAccuracy*0.01 || total.Count() != 90 {
+		t.Errorf(`Quantile(0.99) after subtracting returned %v with count %v, want 0.01 with count 90`, got, total.Count())
+	}
+	total.Subtract(fast)
+	if total.Count() != 0 || len(total.buckets) != 0 || total.Max() != 0 {
+		t.Errorf(`sketch is not empty after subtracting every latency: %+v`, total)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+`SpaceSaving` is an approximate top-K counter which uses bounded memory, for dimensions such as
+full endpoints or client hosts whose number of values is unbounded. It implements the
+Space-Saving algorithm: a fixed number of counters is kept and, when a new key arrives with
+every counter in use, the key with the fewest hits is replaced. The new key inherits that count
+plus one, and the inherited count is recorded as the key's error. A key's reported hits are
+therefore an overestimate of at most its error, and any key with more than n/m hits, for n hits
+over m counters, is guaranteed to be kept. The counters are held in a min-heap, so each hit
+takes O(log m) time and the space required is O(m).
+*/
+package main
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// TopKCounter ranks keys by their number of hits.
+type TopKCounter interface {
+	Hit(key string, bytes int)
+	Hits(key string) int
+	Bytes(key string) int64
+	TopK(k int) []TopKResult
+	Clear()
+}
+
+type SpaceSaving struct {
+	capacity int                         // maximum number of keys counted
+	items    spaceSavingHeap             // counted keys ordered by hits, fewest first
+	index    map[string]*spaceSavingItem // counted keys
+}
+
+type spaceSavingItem struct {
+	key   string
+	hits  int
+	error int   // maximum overestimate of hits
+	bytes int64 // bytes served since the key was counted
+	index int   // index of the item in the heap
+}
+
+// NewSpaceSaving returns a new SpaceSaving counter which counts at most capacity keys.
+func NewSpaceSaving(capacity int) *SpaceSaving {
+	return &SpaceSaving{
+		capacity: capacity,
+		index:    make(map[string]*spaceSavingItem, capacity),
+	}
+}
+
+// Hit records an additional hit for a given key, serving the given number of bytes.
+// This call takes O(log m)
+func (s *SpaceSaving) Hit(key string, bytes int) {
+	if item, found := s.index[key]; found {
+		item.hits++
+		item.bytes += int64(bytes)
+		heap.Fix(&s.items, item.index)
+		return
+	}
+	if len(s.items) < s.capacity {
+		item := &spaceSavingItem{key: key, hits: 1, bytes: int64(bytes)}
+		heap.Push(&s.items, item)
+		s.index[key] = item
+		return
+	}
+
+	// Replace the key with the fewest hits.
+	item := s.items[0]
+	delete(s.index, item.key)
+	item.key = key
+	item.error = item.hits
+	item.hits++
+	item.bytes = int64(bytes)
+	s.index[key] = item
+	heap.Fix(&s.items, 0)
+}
+
+// Hits returns the number of hits counted for a given key, 0 if it is not counted.
+// This call takes O(1)
+func (s *SpaceSaving) Hits(key string) int {
+	if item, found := s.index[key]; found {
+		return item.hits
+	}
+	return 0
+}
+
+// Bytes returns the bytes served for a given key since it was counted, 0 if it is not counted.
+// This call takes O(1)
+func (s *SpaceSaving) Bytes(key string) int64 {
+	if item, found := s.index[key]; found {
+		return item.bytes
+	}
+	return 0
+}
+
+// TopK returns the k keys with the most hits, with ties ordered by key.
+// This call takes O(m log m)
+func (s *SpaceSaving) TopK(k int) []TopKResult {
+	items := make([]*spaceSavingItem, len(s.items))
+	copy(items, s.items)
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].hits != items[j].hits {
+			return items[i].hits > items[j].hits
+		}
+		return items[i].key < items[j].key
+	})
+
+	var result []TopKResult
+	for index := 0; index < k && index < len(items); index++ {
+		item := items[index]
+		result = append(result, TopKResult{item.key, item.hits, item.bytes, item.error})
+	}
+	return result
+}
+
+// Clear resets all hit counts.
+func (s *SpaceSaving) Clear() {
+	s.items = s.items[:0]
+	for k := range s.index {
+		delete(s.index, k)
+	}
+}
+
+// spaceSavingHeap implements heap.Interface, ordering items by hits.
+type spaceSavingHeap []*spaceSavingItem
+
+func (h spaceSavingHeap) Len() int { return len(h) }
+
+func (h spaceSavingHeap) Less(i, j int) bool {
+	return h[i].hits < h[j].hits
+}
+
+func (h spaceSavingHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *spaceSavingHeap) Push(x interface{}) {
+	item := x.(*spaceSavingItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *spaceSavingHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[0 : n-1]
+	return item
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	counter := NewSpaceSaving(2)
+	for _, key := range []string{"/a", "/a", "/b", "/c"} {
+		counter.Hit(key, 10)
+	}
+
+	// /c replaces /b, inheriting its single hit as the error.
+	got := counter.TopK(3)
+	want := []TopKResult{{"/a", 2, 20, 0}, {"/c", 2, 10, 1}}
+	if !cmp.Equal(got, want, cmp.AllowUnexported(TopKResult{})) {
+		t.Errorf(`counter.TopK(3) returned %v, want %v`, got, want)
+	}
+	if counter.Hits("/c") != 2 || counter.Bytes("/c") != 10 || counter.Hits("/b") != 0 {
+		t.Errorf(`counter.Hits and Bytes returned %v and %v for /c and %v for /b, want 2, 10 and 0`,
+			counter.Hits("/c"), counter.Bytes("/c"), counter.Hits("/b"))
+	}
+
+	counter.Clear()
+	if got := counter.TopK(3); len(got) != 0 {
+		t.Errorf(`counter.Clear() then counter.TopK(3) returned %v, want none`, got)
+	}
+}
+
+// zipfKeys returns n keys drawn from a Zipf distribution over the given number of distinct
+// keys, as seen for the endpoints or clients of a busy server.
+func zipfKeys(n int, distinct uint64) []string {
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, distinct-1)
+	keys := make([]string, n)
+	for index := range keys {
+		keys[index] = fmt.Sprintf("/endpoint/%d", zipf.Uint64())
+	}
+	return keys
+}
+
+func TestSpaceSavingErrorBound(t *testing.T) {
+	exact := NewCounter()
+	approximate := NewSpaceSaving(100)
+	for _, key := range zipfKeys(100000, 100000) {
+		exact.Hit(key, 0)
+		approximate.Hit(key, 0)
+	}
+
+	// Each count overestimates the true count by at most its error.
+	for _, got := range approximate.TopK(10) {
+		hits := exact.Hits(got.key)
+		if got.hits < hits || got.hits-got.error > hits {
+			t.Errorf(`SpaceSaving counted %q as %v with error %v, true count %v`, got.key, got.hits, got.error, hits)
+		}
+	}
+
+	// The heaviest keys are found.
+	for index, want := range exact.TopK(3) {
+		if got := approximate.TopK(3)[index]; got.key != want.key {
+			t.Errorf(`SpaceSaving ranked %q at %v, want %q`, got.key, index+1, want.key)
+		}
+	}
+}
+
+func BenchmarkCounterHit(b *testing.B) {
+	keys := zipfKeys(1<<20, 1<<20)
+	counter := NewCounter()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		counter.Hit(keys[i%len(keys)], 0)
+	}
+}
+
+func BenchmarkSpaceSavingHit(b *testing.B) {
+	keys := zipfKeys(1<<20, 1<<20)
+	counter := NewSpaceSaving(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		counter.Hit(keys[i%len(keys)], 0)
+	}
+}
+
+func BenchmarkCounterTopK(b *testing.B) {
+	counter := NewCounter()
+	for _, key := range zipfKeys(1<<20, 1<<20) {
+		counter.Hit(key, 0)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		counter.TopK(10)
+	}
+}
+
+func BenchmarkSpaceSavingTopK(b *testing.B) {
+	counter := NewSpaceSaving(1000)
+	for _, key := range zipfKeys(1<<20, 1<<20) {
+		counter.Hit(key, 0)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		counter.TopK(10)
+	}
+}
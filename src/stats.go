@@ -1,57 +1,178 @@
 /*
-Stats maintains a ranking of the top sections based on the number of hits. Two data
-structures are used to efficiently perform this. An unordered map, with section as key
-and hits as value, keeps count of each section’s total number of hits. An ordered map,
-with hits as key and sections as value, tracks the top sections. Updating the former
-in O(1) time allows the latter to be updated in O(log n) time.
+Stats reports the top sections based on the number of hits over an interval, along with the
+bytes served for each section and for all sections in human readable units. Alongside sections,
+the top values of each `Dimension` are ranked, such as client hosts, users, status codes and
+HTTP methods, each with its own number of results. Each ranking is kept by a `Counter`, or by
+`SpaceSaving` for a dimension with a capacity. Sections are the `sections` dimension, which is
+always counted and reported first, so they too may be counted approximately.
+
+When the log includes request times, the 50th, 90th and 99th percentile and maximum latency are
+reported for each of the top sections. A `LatencySketch` is kept for each section, and these are
+merged to report the latency of all sections. When sections are counted approximately, the
+sketches of sections which are no longer counted are merged into one, so that the number of
+sketches is bounded too.
 */
 package main
 
 import (
 	"fmt"
-
-	"github.com/google/btree"
 )
 
 const (
-	defaultShowTopK = 10
+	defaultShowTopK        = 10
+	defaultShowTopKRanking = 5
+
+	sectionsDimension = "sections"
 )
 
-type TopKEntry struct {
-	hits     int             // number of hits
-	sections map[string]bool // sections with this number of hits
+// StatsReport holds the stats reported for an interval.
+type StatsReport struct {
+	source           string          // source being tracked, empty for all sources
+	tick             int64           // time of the report
+	sections         []TopKResult    // top sections by number of hits
+	bytes            int64           // bytes served for all sections
+	rankings         []Ranking       // top values of other attributes
+	sectionLatencies []LatencyResult // latency of the top sections with a request time
+	latency          LatencyResult   // latency of all sections
 }
 
-// Less is a comparator used by Stats.topK to satisfy the btree.Item interface.
-func (entry TopKEntry) Less(than btree.Item) bool {
-	return entry.hits < than.(TopKEntry).hits
+// LatencyResult is the latency percentiles of a key in a report.
+type LatencyResult struct {
+	key   string
+	count int // number of requests with a request time
+	p50   float64
+	p90   float64
+	p99   float64
+	max   float64
 }
 
-type TopKResult struct {
-	section string
-	hits    int
+// newLatencyResult returns the percentiles of a sketch.
+func newLatencyResult(key string, sketch *LatencySketch) LatencyResult {
+	return LatencyResult{
+		key:   key,
+		count: sketch.Count(),
+		p50:   sketch.Quantile(0.5),
+		p90:   sketch.Quantile(0.9),
+		p99:   sketch.Quantile(0.99),
+		max:   sketch.Max(),
+	}
+}
+
+// Ranking is the top values of a dimension in a report.
+type Ranking struct {
+	name    string
+	results []TopKResult
+}
+
+// ranking counts the values of a dimension, such as the client host.
+type ranking struct {
+	dimension Dimension
+	extract   Extractor
+	counter   TopKCounter
 }
 
 // Stats tracks the number of section hits over a chosen interval.
 type Stats struct {
-	hits       map[string]int // tracks the number of section hits, uses O(n) space
-	topK       *btree.BTree   // maintains the list of sections ordered by number of hits, uses O(n) space
+	name       string   // source being tracked, empty for all sources
+	sink       Sink     // receives reports, nil to discard them
+	sections   *ranking // tracks the hits and bytes of each section
+	totalBytes int64
+	latencies  map[string]*LatencySketch // latencies of each counted section with a request time
+	uncounted  *LatencySketch            // latencies of sections no longer counted
+	rankings   []*ranking
 	tick       int64
 	tickReport int64
 	interval   int64
-	showTopK   int
 }
 
 // NewStats returns a new Stats object used to track statistics.
 func NewStats(interval int64) *Stats {
-	return &Stats{
-		hits:       make(map[string]int),
-		topK:       btree.New(2),
+	s := &Stats{
+		latencies:  make(map[string]*LatencySketch),
+		uncounted:  NewLatencySketch(),
 		tick:       0,
 		tickReport: 0 + interval,
 		interval:   interval,
-		showTopK:   defaultShowTopK,
 	}
+	s.SetDimensions(defaultDimensions())
+	return s
+}
+
+// defaultDimensions returns the dimensions ranked when none are configured, starting with the
+// sections.
+func defaultDimensions() []Dimension {
+	return []Dimension{
+		{Name: sectionsDimension, Key: "section", TopK: defaultShowTopK},
+		{Name: "hosts", Key: "remotehost", TopK: defaultShowTopKRanking},
+		{Name: "users", Key: "authuser", TopK: defaultShowTopKRanking},
+		{Name: "status", Key: "status", TopK: defaultShowTopKRanking},
+		{Name: "methods", Key: "method", TopK: defaultShowTopKRanking},
+	}
+}
+
+// SetDimensions replaces the dimensions which are ranked. A dimension which keeps its name, key
+// and capacity keeps its counts for the current interval. Dimensions with a top k of 0 are not
+// counted, except for the sections, which keep the default sections dimension if none is given.
+func (s *Stats) SetDimensions(dimensions []Dimension) error {
+	sections := defaultDimensions()[0]
+	var rankings []*ranking
+	for _, dimension := range dimensions {
+		if dimension.Name == sectionsDimension {
+			sections = dimension
+			continue
+		}
+		if dimension.TopK == 0 {
+			continue
+		}
+		r, err := s.newRanking(dimension)
+		if err != nil {
+			return err
+		}
+		rankings = append(rankings, r)
+	}
+	r, err := s.newRanking(sections)
+	if err != nil {
+		return err
+	}
+	if s.sections != nil && r.counter != s.sections.counter {
+		// The sections are counted afresh, so the latencies of the old sections are kept only
+		// in the total.
+		s.clearLatencies()
+	}
+	s.sections = r
+	s.rankings = rankings
+	return nil
+}
+
+// newRanking returns the ranking of a dimension, keeping the counts of the current ranking of
+// the same name if it has the same key and capacity.
+func (s *Stats) newRanking(dimension Dimension) (*ranking, error) {
+	extract, err := NewExtractor(dimension.Key)
+	if err != nil {
+		return nil, fmt.Errorf("dimension %q %v", dimension.Name, err)
+	}
+	r := &ranking{dimension: dimension, extract: extract, counter: dimension.newCounter()}
+	for _, old := range append([]*ranking{s.sections}, s.rankings...) {
+		if old != nil && old.dimension.Name == dimension.Name && old.dimension.Key == dimension.Key &&
+			old.dimension.Capacity == dimension.Capacity {
+			r.counter = old.counter
+		}
+	}
+	return r, nil
+}
+
+// Dimensions returns the dimensions which are ranked, starting with the sections.
+func (s *Stats) Dimensions() []Dimension {
+	dimensions := []Dimension{s.sections.dimension}
+	for _, r := range s.rankings {
+		dimensions = append(dimensions, r.dimension)
+	}
+	return dimensions
+}
+
+// Configure applies the number of sections and the dimensions to report.
+func (s *Stats) Configure(config StatsConfig) error {
+	return s.SetDimensions(config.AllDimensions())
 }
 
 // Tick moves the Stats' internal tick forward.
@@ -59,7 +180,17 @@ func NewStats(interval int64) *Stats {
 func (s *Stats) Tick(t int64) {
 	s.tick = t
 	if s.tickReport <= s.tick {
-		sendStats(s.tick, s.TopK(s.showTopK))
+		sections := s.TopK(s.sections.dimension.TopK)
+		sectionLatencies, latency := s.latencyResults(sections)
+		s.send(StatsReport{
+			source:           s.name,
+			tick:             s.tick,
+			sections:         sections,
+			bytes:            s.totalBytes,
+			rankings:         s.rankingResults(),
+			sectionLatencies: sectionLatencies,
+			latency:          latency,
+		})
 		s.Clear()
 		s.tickReport += s.interval
 	}
@@ -71,82 +202,138 @@ func (s *Stats) Sync(t int64) {
 	s.tickReport = t + s.interval
 }
 
-// Hit records an additional hit for a given section.
+// SetInterval changes the time interval between reports. The current interval keeps its start,
+// so it is reported on the next tick if it is already longer than the new interval.
+func (s *Stats) SetInterval(interval int64) {
+	s.tickReport += interval - s.interval
+	if s.tickReport <= s.tick {
+		s.tickReport = s.tick + 1
+	}
+	s.interval = interval
+}
+
+// Hit records an additional hit for the line's section and its value of each dimension.
 // This call takes:
 //   O(1): to update counts.
 //   O(log n):  to update the top k.
-func (s *Stats) Hit(key string) {
-	count, found := s.hits[key]
-	s.hits[key]++
-
-	if found {
-		// Remove section from its current position in the topK.
-		item := s.topK.Get(TopKEntry{count, nil})
-		if item != nil {
-			delete(item.(TopKEntry).sections, key)
+func (s *Stats) Hit(line LogModel) {
+	section, ok := s.sections.extract(line)
+	if ok {
+		s.sections.counter.Hit(section, line.bytes)
+	}
+	s.totalBytes += int64(line.bytes)
+	if line.timed {
+		s.addLatency(section, ok, line.latency)
+	}
+	for _, r := range s.rankings {
+		if value, ok := r.extract(line); ok {
+			r.counter.Hit(value, line.bytes)
+		}
+	}
+}
+
+// addLatency records the request time of a line in the sketch of its section, if it has one.
+func (s *Stats) addLatency(section string, ok bool, latency float64) {
+	if !ok {
+		s.uncounted.Add(latency)
+		return
+	}
+	sketch, found := s.latencies[section]
+	if !found {
+		// An approximate ranking holds at most capacity sections, so once there are twice as
+		// many sketches at least half belong to sections which are no longer counted.
+		if capacity := s.sections.dimension.Capacity; capacity > 0 && len(s.latencies) >= 2*capacity {
+			s.pruneLatencies()
 		}
-		if len(item.(TopKEntry).sections) == 0 {
-			s.topK.Delete(item)
+		sketch = NewLatencySketch()
+		s.latencies[section] = sketch
+	}
+	sketch.Add(latency)
+}
+
+// pruneLatencies merges the sketches of sections which are no longer counted into one.
+func (s *Stats) pruneLatencies() {
+	for section, sketch := range s.latencies {
+		if s.sections.counter.Hits(section) == 0 {
+			s.uncounted.Merge(sketch)
+			delete(s.latencies, section)
 		}
 	}
+}
+
+// clearLatencies merges the sketch of every section into one.
+func (s *Stats) clearLatencies() {
+	for section, sketch := range s.latencies {
+		s.uncounted.Merge(sketch)
+		delete(s.latencies, section)
+	}
+}
+
+// rankingResults returns the top values of each dimension.
+func (s *Stats) rankingResults() []Ranking {
+	var results []Ranking
+	for _, r := range s.rankings {
+		results = append(results, Ranking{r.dimension.Name, r.counter.TopK(r.dimension.TopK)})
+	}
+	return results
+}
 
-	// Add section to its new position in the topK.
-	item := s.topK.Get(TopKEntry{count + 1, nil})
-	if item == nil {
-		s.topK.ReplaceOrInsert(TopKEntry{count + 1, map[string]bool{key: true}})
-	} else {
-		item.(TopKEntry).sections[key] = true
+// latencyResults returns the latency of each of the given sections which has a request time,
+// and of all sections.
+func (s *Stats) latencyResults(sections []TopKResult) ([]LatencyResult, LatencyResult) {
+	var results []LatencyResult
+	for _, section := range sections {
+		if sketch, found := s.latencies[section.key]; found {
+			results = append(results, newLatencyResult(section.key, sketch))
+		}
+	}
+	total := NewLatencySketch()
+	total.Merge(s.uncounted)
+	for _, sketch := range s.latencies {
+		total.Merge(sketch)
 	}
+	return results, newLatencyResult("", total)
 }
 
-// sendStats displays the top sections over the chosen interval.
-var sendStats = func(tick int64, topK []TopKResult) {
-	fmt.Print(ColourYellow)
-	fmt.Printf("[STATS]\t%v\t", tick)
-	for _, got := range topK {
-		fmt.Printf("%s: %v ", got.section, got.hits)
+// send passes a report to the stats' sink.
+func (s *Stats) send(report StatsReport) {
+	if s.sink != nil {
+		s.sink.Stats(report)
 	}
-	fmt.Print("\n")
-	fmt.Print(ColourReset)
 }
 
-// Clear resets all section hit counts.
+// formatPercentiles returns the latency percentiles of a report in human readable units.
+func formatPercentiles(latency LatencyResult) string {
+	return fmt.Sprintf("p50 %s p90 %s p99 %s max %s", formatLatency(latency.p50), formatLatency(latency.p90),
+		formatLatency(latency.p99), formatLatency(latency.max))
+}
+
+// Clear resets all hit counts.
 func (s *Stats) Clear() {
-	for k := range s.hits {
-		delete(s.hits, k)
+	s.sections.counter.Clear()
+	s.totalBytes = 0
+	s.latencies = make(map[string]*LatencySketch)
+	s.uncounted = NewLatencySketch()
+	for _, r := range s.rankings {
+		r.counter.Clear()
 	}
-	s.topK.Clear(false)
 }
 
 // Hits returns the number of hits for a given section.
 // This call takes O(1)
 func (s *Stats) Hits(key string) int {
-	hits, found := s.hits[key]
-	if !found {
-		return 0
-	} else {
-		return hits
-	}
+	return s.sections.counter.Hits(key)
+}
+
+// Bytes returns the number of bytes served for a given section.
+// This call takes O(1)
+func (s *Stats) Bytes(key string) int64 {
+	return s.sections.counter.Bytes(key)
 }
 
 // TopK returns the top k number of sections with the most hits. If multiple sections have
 // the same number of hits, they are all returned.
 // This call takes O(log n)
 func (s *Stats) TopK(k int) []TopKResult {
-	var result []TopKResult
-	if k == 0 || s.topK.Len() == 0 {
-		return result
-	}
-
-	it := func(i btree.Item) bool {
-		hits := i.(TopKEntry).hits
-		for section := range i.(TopKEntry).sections {
-			result = append(result, TopKResult{section, hits})
-			k--
-		}
-		return k > 0
-	}
-	s.topK.Descend(it)
-
-	return result
+	return s.sections.counter.TopK(k)
 }
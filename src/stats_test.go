@@ -1,7 +1,10 @@
 package main
 
 import (
+	"math"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 type StatTest struct {
@@ -27,7 +30,7 @@ func TestStatsHits(t *testing.T) {
 	// Populate hits
 	for _, test := range tests {
 		for i := 0; i < test.want; i++ {
-			stats.Hit(test.input)
+			stats.Hit(LogModel{section: test.input})
 		}
 	}
 
@@ -46,7 +49,7 @@ func TestStatsTopK(t *testing.T) {
 	// Populate hits
 	for _, test := range tests {
 		for i := 0; i < test.want; i++ {
-			stats.Hit(test.input)
+			stats.Hit(LogModel{section: test.input})
 		}
 	}
 
@@ -57,8 +60,8 @@ func TestStatsTopK(t *testing.T) {
 				break
 			}
 			test := tests[index]
-			if got.section != test.input || got.hits != test.want {
-				t.Errorf(`stats.TopK(%v) returned rank %v as {%q: %v}, want {%q: %v}`, k, index+1, got.section, got.hits, test.input, test.want)
+			if got.key != test.input || got.hits != test.want {
+				t.Errorf(`stats.TopK(%v) returned rank %v as {%q: %v}, want {%q: %v}`, k, index+1, got.key, got.hits, test.input, test.want)
 			}
 		}
 	}
@@ -71,7 +74,7 @@ func TestStatsClear(t *testing.T) {
 	// Populate hits.
 	for _, test := range tests {
 		for i := 0; i < test.want; i++ {
-			stats.Hit(test.input)
+			stats.Hit(LogModel{section: test.input})
 		}
 	}
 
@@ -101,3 +104,218 @@ func TestStatsClear(t *testing.T) {
 		t.Errorf(`stats.Clear() then stats.TopK(%v) returned %v results, want %v`, len(tests), len(got), 0)
 	}
 }
+
+func TestStatsSetInterval(t *testing.T) {
+	var got []int64
+	onStats := func(report StatsReport) {
+		got = append(got, report.tick)
+	}
+
+	stats := NewStats(int64(60))
+	stats.sink = funcSink{stats: onStats}
+	stats.Sync(0)
+	for tick := int64(1); tick <= 30; tick++ {
+		stats.Tick(tick)
+	}
+	// The current interval is already longer than the new one, so is reported on the next tick.
+	stats.SetInterval(10)
+	for tick := int64(31); tick <= 50; tick++ {
+		stats.Tick(tick)
+	}
+
+	want := []int64{31, 41}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf(`Stats sent at %v, want %v`, got, want)
+	}
+}
+
+func TestStatsBytes(t *testing.T) {
+	var got StatsReport
+	onStats := func(report StatsReport) {
+		got = report
+	}
+
+	stats := NewStats(int64(10))
+	stats.sink = funcSink{stats: onStats}
+	stats.Sync(0)
+	stats.Hit(LogModel{section: "/api", bytes: 1000})
+	stats.Hit(LogModel{section: "/api", bytes: 500})
+	stats.Hit(LogModel{section: "/report", bytes: 2000})
+	if stats.Bytes("/api") != 1500 || stats.Bytes("/report") != 2000 {
+		t.Errorf(`stats.Bytes returned %v and %v, want 1500 and 2000`, stats.Bytes("/api"), stats.Bytes("/report"))
+	}
+	stats.Tick(10)
+
+	want := []TopKResult{{"/api", 2, 1500, 0}, {"/report", 1, 2000, 0}}
+	if got.bytes != 3500 || len(got.sections) != len(want) || got.sections[0] != want[0] || got.sections[1] != want[1] {
+		t.Errorf(`Stats sent %+v, want sections %+v and 3500 bytes`, got, want)
+	}
+	if stats.Bytes("/api") != 0 || stats.totalBytes != 0 {
+		t.Errorf(`Stats bytes were not cleared after the report`)
+	}
+}
+
+func TestStatsLatency(t *testing.T) {
+	var got StatsReport
+	onStats := func(report StatsReport) {
+		got = report
+	}
+
+	stats := NewStats(int64(10))
+	stats.sink = funcSink{stats: onStats}
+	stats.Sync(0)
+	for i := 1; i <= 100; i++ {
+		stats.Hit(LogModel{section: "/api", latency: float64(i) / 1000, timed: true})
+	}
+	stats.Hit(LogModel{section: "/report", latency: 2, timed: true})
+	stats.Hit(LogModel{section: "/login"})
+	stats.Tick(10)
+
+	want := []LatencyResult{
+		{"/api", 100, 0.05, 0.09, 0.099, 0.1},
+		{"/report", 1, 2, 2, 2, 2},
+	}
+	approx := cmp.Comparer(func(a, b float64) bool {
+		return math.Abs(a-b) <= sketchAccuracy*math.Max(a, b)
+	})
+	if !cmp.Equal(got.sectionLatencies, want, cmp.AllowUnexported(LatencyResult{}), approx) {
+		t.Errorf(`Stats sent section latencies %+v, want %+v`, got.sectionLatencies, want)
+	}
+	if got.latency.count != 101 || got.latency.max != 2 {
+		t.Errorf(`Stats sent total latency %+v, want count 101 and max 2`, got.latency)
+	}
+
+	stats.Tick(20)
+	if got.latency.count != 0 || len(got.sectionLatencies) != 0 {
+		t.Errorf(`Stats latencies were not cleared after the report: %+v`, got)
+	}
+}
+
+func TestFormatLatency(t *testing.T) {
+	var tests = []struct {
+		input float64
+		want  string
+	}{
+		{0, "0µs"},
+		{0.00025, "250µs"},
+		{0.0125, "12.5ms"},
+		{1.5, "1.50s"},
+	}
+	for _, test := range tests {
+		if got := formatLatency(test.input); got != test.want {
+			t.Errorf(`formatLatency(%v) returned %q, want %q`, test.input, got, test.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	var tests = []struct {
+		input int64
+		want  string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KB"},
+		{5 * 1024 * 1024, "5.0 MB"},
+		{3 << 40, "3.0 TB"},
+		{2048 << 40, "2048.0 TB"},
+	}
+	for _, test := range tests {
+		if got := formatBytes(test.input); got != test.want {
+			t.Errorf(`formatBytes(%v) returned %q, want %q`, test.input, got, test.want)
+		}
+	}
+}
+
+func TestStatsRankings(t *testing.T) {
+	var got []Ranking
+	onStats := func(report StatsReport) {
+		got = report.rankings
+	}
+
+	stats := NewStats(int64(10))
+	stats.sink = funcSink{stats: onStats}
+	config := DefaultConfig().Stats
+	config.TopHosts = 1
+	config.TopUsers = 0
+	stats.Configure(config)
+	stats.Sync(0)
+	for _, line := range []LogModel{
+		{remoteHost: "10.0.0.1", authUser: "apache", status: 200, method: "GET"},
+		{remoteHost: "10.0.0.2", authUser: "apache", status: 404, method: "GET"},
+		{remoteHost: "10.0.0.2", authUser: "apache", status: 200, method: "POST"},
+		{remoteHost: "10.0.0.2", status: 500, method: "GET"},
+	} {
+		stats.Hit(line)
+	}
+	stats.Tick(10)
+
+	want := []Ranking{
+		{"hosts", []TopKResult{{"10.0.0.2", 3, 0, 0}}},
+		{"status", []TopKResult{{"200", 2, 0, 0}, {"404", 1, 0, 0}, {"500", 1, 0, 0}}},
+		{"methods", []TopKResult{{"GET", 3, 0, 0}, {"POST", 1, 0, 0}}},
+	}
+	if !cmp.Equal(got, want, cmp.AllowUnexported(Ranking{}, TopKResult{})) {
+		t.Errorf(`Stats sent rankings %v, want %v`, got, want)
+	}
+}
+
+func TestStatsSetDimensions(t *testing.T) {
+	stats := NewStats(int64(10))
+	stats.Hit(LogModel{remoteHost: "10.0.0.1", method: "GET", section: "/api"})
+
+	// The hosts dimension is kept, so keeps its count.
+	dimensions := []Dimension{
+		{Name: "hosts", Key: "remotehost", TopK: 3},
+		{Name: "routes", Key: "method+section", TopK: 3},
+	}
+	if err := stats.SetDimensions(dimensions); err != nil {
+		t.Fatal(err)
+	}
+	stats.Hit(LogModel{remoteHost: "10.0.0.1", method: "GET", section: "/api"})
+
+	want := []Ranking{
+		{"hosts", []TopKResult{{"10.0.0.1", 2, 0, 0}}},
+		{"routes", []TopKResult{{"GET /api", 1, 0, 0}}},
+	}
+	if got := stats.rankingResults(); !cmp.Equal(got, want, cmp.AllowUnexported(Ranking{}, TopKResult{})) {
+		t.Errorf(`Stats ranked %v, want %v`, got, want)
+	}
+
+	if err := stats.SetDimensions([]Dimension{{Name: "a", Key: "colour", TopK: 1}}); err == nil {
+		t.Errorf(`SetDimensions with an unknown attribute returned no error`)
+	}
+}
+
+func TestStatsApproximateSections(t *testing.T) {
+	var got StatsReport
+	onStats := func(report StatsReport) {
+		got = report
+	}
+
+	stats := NewStats(int64(10))
+	stats.sink = funcSink{stats: onStats}
+	config := DefaultConfig().Stats
+	config.Dimensions = []Dimension{{Name: "sections", Key: "section", TopK: 2, Capacity: 2}}
+	if err := stats.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	stats.Sync(0)
+	for index, section := range []string{"/a", "/a", "/b", "/c", "/d", "/e", "/f"} {
+		stats.Hit(LogModel{section: section, bytes: 10, latency: float64(index + 1), timed: true})
+	}
+
+	// Only as many sketches are kept as the sections may need, and none are lost from the total.
+	if len(stats.latencies) > 4 {
+		t.Errorf(`Stats kept %v section latencies, want at most 4`, len(stats.latencies))
+	}
+	stats.Tick(10)
+
+	want := []TopKResult{{"/f", 4, 10, 3}, {"/d", 3, 10, 2}}
+	if !cmp.Equal(got.sections, want, cmp.AllowUnexported(TopKResult{})) {
+		t.Errorf(`Stats sent sections %v, want %v`, got.sections, want)
+	}
+	if got.bytes != 70 || got.latency.count != 7 || got.latency.max != 7 {
+		t.Errorf(`Stats sent %v bytes and total latency %+v, want 70 bytes, count 7 and max 7`, got.bytes, got.latency)
+	}
+}
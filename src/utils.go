@@ -1,5 +1,10 @@
 package main
 
+import (
+	"fmt"
+	"os"
+)
+
 type Colour string
 
 const (
@@ -8,3 +13,44 @@ const (
 	ColourReset  Colour = "\033[0m"
 	ColourYellow Colour = "\033[33m"
 )
+
+// sourceLabel returns the prefix used to identify the source of a message.
+func sourceLabel(source string) string {
+	if len(source) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[%s] ", source)
+}
+
+// formatBytes returns a number of bytes in human readable units.
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	suffixes := []string{"KB", "MB", "GB", "TB"}
+	value := float64(bytes) / unit
+	index := 0
+	for ; value >= unit && index < len(suffixes)-1; index++ {
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f %s", value, suffixes[index])
+}
+
+// formatLatency returns a latency in seconds in human readable units.
+func formatLatency(seconds float64) string {
+	switch {
+	case seconds >= 1:
+		return fmt.Sprintf("%.2fs", seconds)
+	case seconds >= 0.001:
+		return fmt.Sprintf("%.1fms", seconds*1000)
+	default:
+		return fmt.Sprintf("%.0fµs", seconds*1000000)
+	}
+}
+
+// isTerminal reports whether a file is a terminal, rather than a regular file or a pipe.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,417 @@
+/*
+`WebhookSink` delivers alerts to an HTTP endpoint, such as a Slack incoming webhook or an
+incident service like PagerDuty. Each alert is rendered into a request body by a Go template,
+or as a JSON object like those of `-output json` by default, and POSTed to the URL. The sink
+only takes alerts, so the `Player` does not send it stats reports.
+
+Notifications are kept in a bounded queue and delivered in order by a goroutine of the sink's
+own, so an alert never waits for the endpoint. A request which fails with a network error, a
+timeout, or a 429 or 5xx response is retried from a timer, after a delay which doubles with each
+failure until the retries are used up, but never beyond ten minutes. The failure is then
+reported and the queue is retried at that longest delay until the endpoint recovers, whether or
+not further alerts arrive. Closing the sink makes a last attempt to deliver the queue. The queue
+may be saved to a file so that undelivered notifications survive a restart. When the queue is
+full the oldest notification is dropped. A notification rejected with any other 4xx response
+would fail again, so is dropped rather than queued.
+
+Each notification carries a deduplication key made from the rule, group and source of the
+alert, so the receiver can correlate an alert recovering with the alert which fired.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout   = 5 * time.Second
+	defaultWebhookRetries   = 3
+	defaultWebhookBackoff   = time.Second
+	defaultWebhookQueueSize = 100
+	maxWebhookBackoff       = 10 * time.Minute // longest delay between attempts to deliver the queue
+)
+
+type WebhookConfig struct {
+	URL       string   `json:"url"`        // endpoint alerts are POSTed to, empty to disable
+	Template  string   `json:"template"`   // Go template of the request body, empty for a JSON object
+	Timeout   Duration `json:"timeout"`    // timeout of each request
+	Retries   int      `json:"retries"`    // retries after a failed request before the failure is reported
+	Backoff   Duration `json:"backoff"`    // delay before the first retry, doubling with each retry up to 10m
+	Queue     string   `json:"queue"`      // file undelivered notifications are saved to, empty to keep them in memory
+	QueueSize int      `json:"queue_size"` // maximum number of undelivered notifications kept
+}
+
+// Validate checks that the webhook has an HTTP URL, a valid template and usable limits.
+func (c WebhookConfig) Validate() error {
+	endpoint, err := url.Parse(c.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || len(endpoint.Host) == 0 {
+		return fmt.Errorf("url %q must be an http or https URL", c.URL)
+	}
+	if _, err := c.parseTemplate(); err != nil {
+		return fmt.Errorf("template: %v", err)
+	}
+	if c.Timeout.Duration <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	if c.Backoff.Duration <= 0 || c.Backoff.Duration > maxWebhookBackoff {
+		return fmt.Errorf("backoff must be positive and at most %v", maxWebhookBackoff)
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("queue_size must be positive")
+	}
+	return nil
+}
+
+// retryDelay returns the delay before the queue is retried after the given number of consecutive
+// failures, doubling from the backoff with each failure until the retries are used up or the
+// delay reaches maxWebhookBackoff.
+func (c WebhookConfig) retryDelay(failures int) time.Duration {
+	delay := c.Backoff.Duration
+	for doublings := 1; doublings < failures && doublings <= c.Retries && delay < maxWebhookBackoff; doublings++ {
+		delay *= 2
+	}
+	if delay > maxWebhookBackoff {
+		delay = maxWebhookBackoff
+	}
+	return delay
+}
+
+// parseTemplate returns the template of the request body, or nil for a JSON object.
+func (c WebhookConfig) parseTemplate() (*template.Template, error) {
+	if len(c.Template) == 0 {
+		return nil, nil
+	}
+	return template.New("webhook").Funcs(template.FuncMap{"json": toJSON}).Parse(c.Template)
+}
+
+// toJSON returns a value as JSON, such as a quoted and escaped string, for use in templates.
+func toJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// webhookEvent is the data of a notification, given to the template or sent as a JSON object.
+type webhookEvent struct {
+	alertEvent
+	DedupKey string `json:"dedup_key"`
+}
+
+// notification is a request body waiting to be delivered.
+type notification struct {
+	DedupKey string `json:"dedup_key"`
+	Body     string `json:"body"`
+}
+
+// rejectedError is returned when the endpoint rejects a notification, which should not be
+// retried.
+type rejectedError struct {
+	status string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("webhook rejected notification: %s", e.status)
+}
+
+// WebhookSink POSTs alerts to an HTTP endpoint. The queue is shared by Alert and the sink's
+// goroutine, and guarded by mu. The goroutine posts the head of the queue without holding the
+// lock, so a full queue drops the oldest notification behind the one being posted, and the head
+// is only removed once delivered if no alert has dropped it in the meantime.
+type WebhookSink struct {
+	config   WebhookConfig
+	template *template.Template // template of the request body, nil for a JSON object
+	client   *http.Client
+	mu       sync.Mutex
+	queue    []notification // undelivered notifications, oldest first
+	removed  int            // notifications removed from the head of the queue
+	posting  bool           // the head of the queue is being posted
+	dropped  int            // notifications dropped as the queue was full
+	failures int            // consecutive failed attempts to deliver the queue
+	wake     chan struct{}  // signals the sink's goroutine that a notification was queued
+	stop     chan struct{}  // closed to stop the sink's goroutine
+	report   io.Writer      // destination for delivery failures
+	stopped  sync.WaitGroup
+}
+
+// NewWebhookSink returns a Sink which POSTs alerts to the configured URL. Notifications left
+// undelivered in the queue file are loaded and delivered straight away.
+func NewWebhookSink(config WebhookConfig) (*WebhookSink, error) {
+	return newWebhookSink(config, os.Stderr)
+}
+
+// newWebhookSink returns a webhook sink which reports delivery failures to report.
+func newWebhookSink(config WebhookConfig, report io.Writer) (*WebhookSink, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("webhook %v", err)
+	}
+	tmpl, _ := config.parseTemplate()
+	s := &WebhookSink{
+		config:   config,
+		template: tmpl,
+		client:   &http.Client{Timeout: config.Timeout.Duration},
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		report:   report,
+	}
+	if len(config.Queue) > 0 {
+		queue, err := loadQueue(config.Queue)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read webhook queue: %v", err)
+		}
+		for _, n := range queue {
+			s.enqueue(n)
+		}
+	}
+	s.stopped.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// AlertsOnly marks the sink as taking no stats reports.
+func (s *WebhookSink) AlertsOnly() {}
+
+// Stats ignores stats reports, as only alerts are delivered.
+func (s *WebhookSink) Stats(report StatsReport) error {
+	return nil
+}
+
+// Alert queues a notification of the alert and wakes the sink's goroutine to deliver it, without
+// waiting for the endpoint.
+func (s *WebhookSink) Alert(alert Alert) error {
+	n, err := s.notification(alert)
+	if err != nil {
+		return err
+	}
+	s.enqueue(n)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// The goroutine has yet to take the last signal, so will find this notification too.
+	}
+	return nil
+}
+
+// Close stops the sink's goroutine and makes a last attempt to deliver the queue, leaving any
+// undelivered notifications in the queue file.
+func (s *WebhookSink) Close() error {
+	close(s.stop)
+	s.stopped.Wait()
+	var failed error
+	if err := s.deliverQueue(); err != nil {
+		failed = fmt.Errorf("webhook delivery failed, %v notifications queued: %v", s.queued(), err)
+	}
+	if s.dropped > 0 {
+		fmt.Fprintf(s.report, "%v webhook notifications dropped as the queue was full.\n", s.dropped)
+	}
+	return failed
+}
+
+// run delivers the queue as notifications are queued, retrying from a timer while the endpoint
+// is failing, until the sink is closed.
+func (s *WebhookSink) run() {
+	defer s.stopped.Done()
+	retry := s.flush() // fires when the queue is to be retried, nil if it is empty
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+			if retry == nil {
+				retry = s.flush()
+			} else {
+				// The endpoint is failing, so the notification waits for the retry.
+				s.saveQueue()
+			}
+		case <-retry:
+			retry = s.flush()
+		}
+	}
+}
+
+// notification renders the request body of an alert.
+func (s *WebhookSink) notification(alert Alert) (notification, error) {
+	event := webhookEvent{newAlertEvent(alert), dedupKey(alert)}
+	if s.template == nil {
+		body, err := json.Marshal(event)
+		return notification{event.DedupKey, string(body)}, err
+	}
+	var body bytes.Buffer
+	if err := s.template.Execute(&body, event); err != nil {
+		return notification{}, fmt.Errorf("webhook template: %v", err)
+	}
+	return notification{event.DedupKey, body.String()}, nil
+}
+
+// dedupKey returns the key shared by the notifications of an alert firing and recovering, made
+// from the rule, group and source of the alert.
+func dedupKey(alert Alert) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{alert.rule, alert.key, alert.source}, "\x00")))
+	return hex.EncodeToString(hash[:16])
+}
+
+// enqueue adds a notification to the end of the queue, dropping the oldest if it is full.
+func (s *WebhookSink) enqueue(n notification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) >= s.config.QueueSize {
+		if s.posting && len(s.queue) > 1 {
+			s.queue = append(s.queue[:1], s.queue[2:]...)
+		} else {
+			s.queue = s.queue[1:]
+			s.removed++
+		}
+		s.dropped++
+	}
+	s.queue = append(s.queue, n)
+}
+
+// head returns the oldest notification in the queue to be posted and the number removed before
+// it, or false if the queue is empty.
+func (s *WebhookSink) head() (notification, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return notification{}, s.removed, false
+	}
+	s.posting = true
+	return s.queue[0], s.removed, true
+}
+
+// queued returns the number of notifications in the queue.
+func (s *WebhookSink) queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// flush attempts to deliver the queue. If a notification cannot be delivered it returns a
+// channel which fires when the queue is to be retried, after the retry delay, and otherwise nil.
+func (s *WebhookSink) flush() <-chan time.Time {
+	err := s.deliverQueue()
+	if err == nil {
+		s.failures = 0
+		return nil
+	}
+	s.failures++
+	if s.failures == s.config.Retries+1 {
+		fmt.Fprintf(s.report, "Webhook delivery failed, %v notifications queued: %v.\n", s.queued(), err)
+	}
+	return time.After(s.config.retryDelay(s.failures))
+}
+
+// deliverQueue makes a single attempt to deliver the queued notifications in order, stopping at
+// the first which cannot be delivered, and saves what remains of the queue.
+func (s *WebhookSink) deliverQueue() error {
+	var failed error
+	for failed == nil {
+		n, removed, ok := s.head()
+		if !ok {
+			break
+		}
+		err := s.post(n)
+		var rejected *rejectedError
+		if errors.As(err, &rejected) {
+			fmt.Fprintf(s.report, "%v, dropped.\n", err)
+			err = nil
+		}
+		failed = err
+		s.mu.Lock()
+		s.posting = false
+		if failed == nil && s.removed == removed {
+			s.queue = s.queue[1:]
+			s.removed++
+		}
+		s.mu.Unlock()
+	}
+	s.saveQueue()
+	return failed
+}
+
+// saveQueue saves the queue to the queue file, if any, reporting any failure.
+func (s *WebhookSink) saveQueue() {
+	if len(s.config.Queue) == 0 {
+		return
+	}
+	s.mu.Lock()
+	queue := append([]notification(nil), s.queue...)
+	s.mu.Unlock()
+	if err := saveQueue(s.config.Queue, queue); err != nil {
+		fmt.Fprintf(s.report, "Unable to save webhook queue: %v.\n", err)
+	}
+}
+
+// post makes a single attempt to deliver a notification.
+func (s *WebhookSink) post(n notification) error {
+	response, err := s.client.Post(s.config.URL, "application/json", strings.NewReader(n.Body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	switch {
+	case response.StatusCode < 300:
+		return nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return fmt.Errorf("webhook returned %s", response.Status)
+	default:
+		return &rejectedError{response.Status}
+	}
+}
+
+// loadQueue reads the notifications saved in a queue file, one JSON object per line. A missing
+// file is an empty queue.
+func loadQueue(path string) ([]notification, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var queue []notification
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var n notification
+		if err := json.Unmarshal(scanner.Bytes(), &n); err != nil {
+			return nil, err
+		}
+		queue = append(queue, n)
+	}
+	return queue, scanner.Err()
+}
+
+// saveQueue replaces the queue file with the given notifications. The file is written in full
+// and renamed into place, so a crash leaves either the old or the new queue.
+func saveQueue(path string, queue []notification) error {
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	for _, n := range queue {
+		if err := encoder.Encode(n); err != nil {
+			return err
+		}
+	}
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, data.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
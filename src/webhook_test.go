@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer is a test endpoint which records the bodies it receives and responds with
+// the given statuses in turn, then with 200.
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	bodies   []string
+	statuses []int
+}
+
+func newWebhookServer(statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.bodies = append(s.bodies, string(body))
+		if len(s.statuses) > 0 {
+			w.WriteHeader(s.statuses[0])
+			s.statuses = s.statuses[1:]
+		}
+	}))
+	return s
+}
+
+func (s *webhookServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+// webhookConfig returns a config for the server with short delays.
+func webhookConfig(server *webhookServer) WebhookConfig {
+	config := DefaultConfig().Webhook
+	config.URL = server.URL
+	config.Backoff = Duration{time.Millisecond}
+	config.Timeout = Duration{time.Second}
+	return config
+}
+
+// waitFor waits up to a second for a condition to hold, returning whether it did.
+func waitFor(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+func TestWebhookSink(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	sink, err := NewWebhookSink(webhookConfig(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert := Alert{rule: "section_traffic", description: "Section traffic", key: "/api", state: AlertFiring,
+		severity: SeverityCritical, metric: MetricHits, value: 12, hits: 12, threshold: 10, window: 5, time: 11}
+	if err := sink.Alert(alert); err != nil {
+		t.Fatal(err)
+	}
+	alert.state, alert.value, alert.hits, alert.time = AlertNone, 4, 4, 20
+	if err := sink.Alert(alert); err != nil {
+		t.Fatal(err)
+	}
+	// A different group of the same rule is a different alert.
+	alert.key = "/report"
+	sink.Alert(alert)
+	sink.Stats(StatsReport{tick: 20})
+	sink.Close()
+
+	bodies := server.received()
+	if len(bodies) != 3 {
+		t.Fatalf(`Webhook received %v notifications, want 3`, len(bodies))
+	}
+	var events []webhookEvent
+	for _, body := range bodies {
+		var event webhookEvent
+		if err := json.Unmarshal([]byte(body), &event); err != nil {
+			t.Fatalf(`Webhook body %q is not JSON: %v`, body, err)
+		}
+		events = append(events, event)
+	}
+	if events[0].State != "firing" || events[1].State != "recovered" || events[0].Rule != "section_traffic" ||
+		events[0].Key != "/api" || events[0].Hits != 12 || events[0].Threshold != 10 || events[0].Window != 5 {
+		t.Errorf(`Webhook received %v, want firing then recovered alerts for /api`, bodies[:2])
+	}
+	if len(events[0].DedupKey) == 0 || events[0].DedupKey != events[1].DedupKey {
+		t.Errorf(`Firing and recovered alerts have dedup keys %q and %q, want the same key`, events[0].DedupKey, events[1].DedupKey)
+	}
+	if events[2].DedupKey == events[0].DedupKey {
+		t.Errorf(`Alerts for different groups have the same dedup key %q`, events[0].DedupKey)
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	config := webhookConfig(server)
+	config.Template = `{"text": {{printf "%s %s alert: %s = %v" .Description .State .Metric .Value | json}}}`
+	sink, err := NewWebhookSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink.Alert(Alert{rule: "high_traffic", description: `High "traffic"`, state: AlertFiring, metric: MetricHits, value: 12})
+	sink.Close()
+
+	want := `{"text": "High \"traffic\" firing alert: hits = 12"}`
+	if bodies := server.received(); len(bodies) != 1 || bodies[0] != want {
+		t.Errorf(`Webhook received %q, want %q`, bodies, want)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	server := newWebhookServer(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer server.Close()
+	var report bytes.Buffer
+	sink, err := newWebhookSink(webhookConfig(server), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sink.Alert(Alert{rule: "high_traffic", state: AlertFiring}); err != nil {
+		t.Errorf(`Webhook alert returned %v, want no error`, err)
+	}
+	// The alert is retried in the background, so does not hold up the caller.
+	if !waitFor(func() bool { return len(server.received()) == 3 }) {
+		t.Errorf(`Webhook received %v attempts, want 3`, len(server.received()))
+	}
+	if err := sink.Close(); err != nil || len(sink.queue) != 0 || report.Len() != 0 {
+		t.Errorf(`Webhook closed with %v, %v queued and reported %q, want no error, 0 and no report`,
+			err, len(sink.queue), report.String())
+	}
+}
+
+func TestWebhookRecovers(t *testing.T) {
+	server := newWebhookServer(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusBadGateway)
+	defer server.Close()
+	config := webhookConfig(server)
+	config.Retries = 1
+	var report bytes.Buffer
+	sink, err := newWebhookSink(config, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failure is reported once the retries are used up, and the queue is retried from the
+	// timer until the endpoint recovers, with no further alert to prompt it.
+	sink.Alert(Alert{rule: "high_traffic", state: AlertFiring})
+	if !waitFor(func() bool { return len(server.received()) == 4 }) {
+		t.Errorf(`Webhook received %v attempts before it was closed, want 4`, len(server.received()))
+	}
+	if err := sink.Close(); err != nil || len(sink.queue) != 0 {
+		t.Errorf(`Webhook closed with %v and %v queued after the endpoint recovered, want no error and 0`, err, len(sink.queue))
+	}
+	if want := "Webhook delivery failed, 1 notifications queued: webhook returned 503"; !strings.HasPrefix(report.String(), want) {
+		t.Errorf(`Webhook reported %q, want %q`, report.String(), want)
+	}
+	if bodies := server.received(); len(bodies) != 4 || bodies[3] != bodies[0] {
+		t.Errorf(`Webhook received %q, want the same notification 4 times`, bodies)
+	}
+}
+
+func TestWebhookRejected(t *testing.T) {
+	server := newWebhookServer(http.StatusBadRequest)
+	defer server.Close()
+	var report bytes.Buffer
+	sink, err := newWebhookSink(webhookConfig(server), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A rejected notification is reported and dropped rather than retried or queued.
+	sink.Alert(Alert{rule: "high_traffic", state: AlertFiring})
+	if err := sink.Close(); err != nil {
+		t.Errorf(`Webhook closed with %v after a rejection, want no error`, err)
+	}
+	if !strings.Contains(report.String(), "400") {
+		t.Errorf(`Webhook reported %q, want a rejection`, report.String())
+	}
+	if bodies := server.received(); len(bodies) != 1 || len(sink.queue) != 0 {
+		t.Errorf(`Webhook received %v attempts and queued %v, want 1 and 0`, len(bodies), len(sink.queue))
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhook.queue")
+	// The endpoint is down, so connections are refused.
+	down := newWebhookServer()
+	down.Close()
+	config := webhookConfig(down)
+	config.Retries = 1
+	config.Queue = path
+	config.QueueSize = 2
+	var report bytes.Buffer
+	sink, err := newWebhookSink(config, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The alerts wait in the queue, and the oldest is dropped once it is full.
+	for _, rule := range []string{"a", "b", "c"} {
+		sink.Alert(Alert{rule: rule, state: AlertFiring})
+	}
+	if err := sink.Close(); err == nil || !strings.Contains(err.Error(), "2 notifications queued") {
+		t.Errorf(`Webhook closed with %v while the endpoint is down, want 2 notifications queued`, err)
+	}
+	if sink.dropped != 1 {
+		t.Errorf(`Webhook dropped %v notifications, want 1`, sink.dropped)
+	}
+
+	// Once restarted, the saved notifications are delivered in order before the next alert.
+	up := newWebhookServer()
+	defer up.Close()
+	config.URL = up.URL
+	config.QueueSize = 3
+	sink, err = NewWebhookSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Alert(Alert{rule: "d", state: AlertFiring}); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	var rules []string
+	for _, body := range up.received() {
+		var event webhookEvent
+		json.Unmarshal([]byte(body), &event)
+		rules = append(rules, event.Rule)
+	}
+	if strings.Join(rules, ",") != "b,c,d" {
+		t.Errorf(`Webhook delivered alerts for rules %v, want [b c d]`, rules)
+	}
+	if queue, err := loadQueue(path); err != nil || len(queue) != 0 {
+		t.Errorf(`Webhook queue file holds %v, %v after delivery, want an empty queue`, queue, err)
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	var tests = []struct {
+		backoff  time.Duration
+		retries  int
+		failures int
+		want     time.Duration
+	}{
+		{time.Second, 3, 1, time.Second},
+		{time.Second, 3, 2, 2 * time.Second},
+		{time.Second, 3, 4, 8 * time.Second},
+		{time.Second, 3, 100, 8 * time.Second},
+		// Many retries neither overflow the delay nor wait beyond the maximum.
+		{time.Second, 1000, 1000, maxWebhookBackoff},
+		{time.Nanosecond, 1 << 30, 1 << 30, maxWebhookBackoff},
+	}
+	for _, test := range tests {
+		config := WebhookConfig{Backoff: Duration{test.backoff}, Retries: test.retries}
+		if got := config.retryDelay(test.failures); got != test.want {
+			t.Errorf(`Retry delay after %v failures with a backoff of %v and %v retries was %v, want %v`,
+				test.failures, test.backoff, test.retries, got, test.want)
+		}
+	}
+}
+
+func TestWebhookSlowEndpoint(t *testing.T) {
+	release := make(chan bool)
+	var mu sync.Mutex
+	var rules []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		rules = append(rules, event.Rule)
+		mu.Unlock()
+		<-release
+	}))
+	defer server.Close()
+	config := webhookConfig(&webhookServer{Server: server})
+	config.QueueSize = 2
+	var report bytes.Buffer
+	sink, err := newWebhookSink(config, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// While the endpoint holds the first request, further alerts are queued without waiting,
+	// and the oldest behind it are dropped and counted once the queue is full.
+	sink.Alert(Alert{rule: "a", state: AlertFiring})
+	if !waitFor(func() bool { mu.Lock(); defer mu.Unlock(); return len(rules) == 1 }) {
+		t.Fatal(`Webhook did not post the first alert`)
+	}
+	queued := make(chan bool)
+	go func() {
+		for _, rule := range []string{"b", "c", "d"} {
+			sink.Alert(Alert{rule: rule, state: AlertFiring})
+		}
+		queued <- true
+	}()
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatal(`Webhook alerts waited for a slow endpoint`)
+	}
+	close(release)
+	if err := sink.Close(); err != nil {
+		t.Errorf(`Webhook closed with %v, want no error`, err)
+	}
+
+	if strings.Join(rules, ",") != "a,d" || sink.dropped != 2 {
+		t.Errorf(`Webhook delivered alerts for rules %v and dropped %v, want [a d] and 2`, rules, sink.dropped)
+	}
+	if want := "2 webhook notifications dropped"; !strings.Contains(report.String(), want) {
+		t.Errorf(`Webhook reported %q, want %q`, report.String(), want)
+	}
+}
+
+func TestWebhookConfigValidate(t *testing.T) {
+	var tests = []struct {
+		update func(c *WebhookConfig)
+		want   string
+	}{
+		{func(c *WebhookConfig) { c.URL = "hooks.example.com" }, "url"},
+		{func(c *WebhookConfig) { c.URL = "ftp://hooks.example.com" }, "url"},
+		{func(c *WebhookConfig) { c.Template = "{{.Rule" }, "template"},
+		{func(c *WebhookConfig) { c.Timeout = Duration{} }, "timeout"},
+		{func(c *WebhookConfig) { c.Retries = -1 }, "retries"},
+		{func(c *WebhookConfig) { c.Backoff = Duration{} }, "backoff"},
+		{func(c *WebhookConfig) { c.Backoff = Duration{time.Hour} }, "backoff"},
+		{func(c *WebhookConfig) { c.QueueSize = 0 }, "queue_size"},
+	}
+	for index, test := range tests {
+		config := DefaultConfig().Webhook
+		config.URL = "https://hooks.example.com/alerts"
+		if err := config.Validate(); err != nil {
+			t.Fatalf(`Validate of a valid webhook returned %v`, err)
+		}
+		test.update(&config)
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf(`Validate test %v returned %v, want %q`, index, err, test.want)
+		}
+	}
+}